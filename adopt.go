@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Adopt config tree
+//
+// adopt subcommand turns existing config tree into templates. Every value
+// of env file found in a file is replaced with {{ .Env "NAME" }}, longer
+// values first, and only where value is not a part of longer word. Existing
+// "{{" are escaped. Adopted templates are rendered back with the same env
+// file and must reproduce the tree exactly.
+type adoptValue struct {
+	name  string
+	value string
+}
+
+// adoptValues returns values of env file longest first, values shared by
+// several variables are taken by first of them
+func adoptValues(path string, minLength int) ([]adoptValue, []string, error) {
+	vx := &TemplateContext{envs: map[string]string{}, sources: map[string][]envSource{}}
+	err := vx.loadEnvFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := []string{}
+	for name := range vx.envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	notes := []string{}
+	values := []adoptValue{}
+	owners := map[string]string{}
+	for _, name := range names {
+		value := vx.envs[name]
+		switch owner, ok := owners[value]; {
+		case utf8.RuneCountInString(value) < minLength:
+			notes = append(notes, fmt.Sprintf("%v: value is shorter than %v, not replaced", name, minLength))
+		case ok:
+			notes = append(notes, fmt.Sprintf("%v: has the same value as %v, replaced by %v", name, owner, owner))
+		default:
+			owners[value] = name
+			values = append(values, adoptValue{name, value})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool { return len(values[i].value) > len(values[j].value) })
+	return values, notes, nil
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// atBoundary returns true when value at s[i:j] is not a part of longer word
+func atBoundary(s string, i, j int) bool {
+	first, _ := utf8.DecodeRuneInString(s[i:j])
+	last, _ := utf8.DecodeLastRuneInString(s[i:j])
+	if isWordRune(first) && i > 0 {
+		if r, _ := utf8.DecodeLastRuneInString(s[:i]); isWordRune(r) {
+			return false
+		}
+	}
+	if isWordRune(last) && j < len(s) {
+		if r, _ := utf8.DecodeRuneInString(s[j:]); isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// adoptContent returns template of content and number of replaced values
+func adoptContent(content string, values []adoptValue, replace bool) (string, int) {
+	buf := new(strings.Builder)
+	n := 0
+scan:
+	for i := 0; i < len(content); {
+		if replace {
+			for _, v := range values {
+				j := i + len(v.value)
+				if strings.HasPrefix(content[i:], v.value) && atBoundary(content, i, j) {
+					fmt.Fprintf(buf, `{{ .Env %q }}`, v.name)
+					n++
+					i = j
+					continue scan
+				}
+			}
+		}
+		if strings.HasPrefix(content[i:], "{{") {
+			buf.WriteString(`{{ "{{" }}`)
+			i += 2
+			continue
+		}
+		buf.WriteByte(content[i])
+		i++
+	}
+	return buf.String(), n
+}
+
+func Adopt(args []string) error {
+	var from, values, to string
+	var minLength int
+	flagSet := flag.NewFlagSet("envtemplater adopt", flag.ContinueOnError)
+	flagSet.StringVar(&from, "from", "", "Existing config dir")
+	flagSet.StringVar(&values, "values", "", "Env file with values used in config dir")
+	flagSet.StringVar(&to, "to", "", "Templates dir to create")
+	flagSet.IntVar(&minLength, "min-length", 3, "Shorter values are not replaced")
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+	if from == "" || values == "" || to == "" {
+		return fmt.Errorf("Required from, values and to")
+	}
+
+	known, notes, err := adoptValues(values, minLength)
+	if err != nil {
+		return err
+	}
+	for _, note := range notes {
+		fmt.Println("note", note)
+	}
+
+	names, err := recursiveGetFiles(from)
+	if err != nil {
+		return err
+	}
+	// never overwrite existing templates
+	for _, name := range names {
+		path := filepath.Join(to, name)
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("File '%v' already exists", path)
+		}
+	}
+	createdDirs, err := recursiveCopyDir(from, to, copyDirOptions{})
+	defer func() { applyDirModes(createdDirs) }()
+	if err != nil {
+		return err
+	}
+
+	tx := NewTemplateContext()
+	err = tx.loadEnvFile(values)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		inputPath, outputPath := filepath.Join(from, name), filepath.Join(to, name)
+		info, err := os.Stat(inputPath)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(inputPath)
+		if err != nil {
+			return err
+		}
+		// binary files are only escaped
+		text := utf8.Valid(b) && !bytes.ContainsRune(b, 0)
+		content, n := adoptContent(string(b), known, text)
+		err = os.WriteFile(outputPath, []byte(content), info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+
+		// render back
+		tf := NewTemplateFile(tx, name, outputPath, inputPath)
+		tf.Settings = defaultDirSettings()
+		err = tf.LoadInput()
+		if err == nil {
+			err = tf.Template()
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", outputPath, err)
+		}
+		if tf.Output != string(b) {
+			return fmt.Errorf("%v: rendered template differs from '%v'", outputPath, inputPath)
+		}
+		fmt.Printf("adopted %v: %v values\n", outputPath, n)
+	}
+	err = applyDirModes(createdDirs)
+	createdDirs = nil
+	if err != nil {
+		return err
+	}
+	fmt.Printf("render with: envtemplater -id %v -od %v -ef %v\n", to, from, values)
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAdoptContent(t *testing.T) {
+	values := []adoptValue{
+		{"DB_URL", "db.example.com:5432"},
+		{"DOMAIN", "example.com"},
+		{"USER", "admin"},
+		{"PORT", "5432"},
+	}
+	tests := []struct {
+		name    string
+		content string
+		replace bool
+		want    string
+		n       int
+	}{
+		{
+			name:    "value on its own",
+			content: "user = admin\n",
+			replace: true,
+			want:    "user = {{ .Env \"USER\" }}\n",
+			n:       1,
+		},
+		{
+			name:    "value inside longer word",
+			content: "user = administrator\nport = 54321\n",
+			replace: true,
+			want:    "user = administrator\nport = 54321\n",
+		},
+		{
+			name:    "value next to punctuation",
+			content: "url = https://example.com/admin/\n",
+			replace: true,
+			want:    "url = https://{{ .Env \"DOMAIN\" }}/{{ .Env \"USER\" }}/\n",
+			n:       2,
+		},
+		{
+			name:    "longer value wins over overlapping one",
+			content: "db = db.example.com:5432, port = 5432\n",
+			replace: true,
+			want:    "db = {{ .Env \"DB_URL\" }}, port = {{ .Env \"PORT\" }}\n",
+			n:       2,
+		},
+		{
+			name:    "existing braces are escaped",
+			content: "tpl = {{ admin }}\n",
+			replace: true,
+			want:    "tpl = {{ \"{{\" }} {{ .Env \"USER\" }} }}\n",
+			n:       1,
+		},
+		{
+			name:    "binary content is only escaped",
+			content: "\x00admin{{\x01",
+			replace: false,
+			want:    "\x00admin{{ \"{{\" }}\x01",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, n := adoptContent(tt.content, values, tt.replace)
+			if got != tt.want || n != tt.n {
+				t.Errorf("got %q, %v, want %q, %v", got, n, tt.want, tt.n)
+			}
+		})
+	}
+}
+
+func TestAtBoundary(t *testing.T) {
+	tests := []struct {
+		s    string
+		i, j int
+		want bool
+	}{
+		{"admin", 0, 5, true},
+		{"xadmin", 1, 6, false},
+		{"admin_x", 0, 5, false},
+		{"/admin/", 1, 6, true},
+		{"éadmin", 2, 7, false},
+		{"a.b", 1, 2, true}, // value without word runes at edges
+		{"x:80", 1, 4, true},
+	}
+	for _, tt := range tests {
+		if got := atBoundary(tt.s, tt.i, tt.j); got != tt.want {
+			t.Errorf("atBoundary(%q, %v, %v) = %v, want %v", tt.s, tt.i, tt.j, got, tt.want)
+		}
+	}
+}
+
+func TestAdoptValues(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"values.env": "A=host\nB=host\nC=ab\nD=longer value\n"})
+	values, notes, err := adoptValues(filepath.Join(dir, "values.env"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []adoptValue{{"D", "longer value"}, {"A", "host"}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+	wantNotes := []string{
+		"B: has the same value as A, replaced by A",
+		"C: value is shorter than 3, not replaced",
+	}
+	if !reflect.DeepEqual(notes, wantNotes) {
+		t.Errorf("got notes %q, want %q", notes, wantNotes)
+	}
+}
+
+func TestAdoptRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "etc"), filepath.Join(dir, "templates")
+	files := map[string]string{
+		"etc/app.conf":        "host = db.internal\nadmin_host = db.internal2\n",
+		"etc/nginx/site.conf": "server_name www.example.com;\nset $v \"{{ not a template }}\";\n",
+		"etc/logo.bin":        "\x00\x01db.internal{{\xff",
+		"values.env":          "HOST=db.internal\nDOMAIN=www.example.com\n",
+	}
+	writeFiles(t, dir, files)
+
+	err := Adopt([]string{"-from", from, "-values", filepath.Join(dir, "values.env"), "-to", to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(to, "app.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "host = {{ .Env \"HOST\" }}\nadmin_host = db.internal2\n"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+
+	// rendered templates reproduce the tree
+	out := filepath.Join(dir, "out")
+	flags, err := NewFlags([]string{"-id", to, "-od", out, "-ef", filepath.Join(dir, "values.env")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Run(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		rel, err := filepath.Rel("etc", name)
+		if err != nil || rel == ".." || name == "values.env" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(out, rel))
+		if err != nil || string(b) != content {
+			t.Errorf("%v: got %q, %v, want %q", rel, b, err, content)
+		}
+	}
+
+	// existing templates are never overwritten
+	err = Adopt([]string{"-from", from, "-values", filepath.Join(dir, "values.env"), "-to", to})
+	if err == nil {
+		t.Error("expected error adopting into existing templates")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Hashed assets
+//
+// File with "hashName: true" in front matter gets content hash in its output
+// name, e.g. app.js is saved as app.3f9a1c.js. Mapping of original names to
+// hashed ones is saved as manifest.json in output dir and is available to
+// other templates through asset function. Output named manifest.json is an
+// error then.
+//
+// Hashed files are rendered before other files, but in plain list order
+// among themselves, so hashed file can't refer another hashed file.
+const assetManifestName = "manifest.json"
+
+func (tf *TemplateFile) HashName() bool {
+	return tf.FrontMatter["hashName"] == "true"
+}
+
+func (tf *TemplateFile) applyHashName() {
+	sum := sha256.Sum256([]byte(tf.Output))
+	hash := hex.EncodeToString(sum[:])[:6]
+
+	ext := filepath.Ext(tf.OutputPath)
+	tf.OutputPath = strings.TrimSuffix(tf.OutputPath, ext) + "." + hash + ext
+
+	ext = path.Ext(tf.Name)
+	tf.TemplateContext.assets[tf.Name] = strings.TrimSuffix(tf.Name, ext) + "." + hash + ext
+}
+
+func (tx *TemplateContext) asset(name string) (string, error) {
+	hashed, ok := tx.assets[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown asset '%v', file must be rendered with hashName and can't be referred from hashed file", name)
+	}
+	return hashed, nil
+}
+
+// assetManifest returns manifest content, nil when there are no assets
+func (tx *TemplateContext) assetManifest() ([]byte, error) {
+	if len(tx.assets) == 0 {
+		return nil, nil
+	}
+	b, err := json.MarshalIndent(tx.assets, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// checkAssetManifestName fails when manifest would replace rendered file
+func checkAssetManifestName(flags Flags, templateFiles []*TemplateFile, manifest []byte) error {
+	if manifest == nil {
+		return nil
+	}
+	for _, templateFile := range templateFiles {
+		if outputName(flags, templateFile.OutputPath) == assetManifestName {
+			return fmt.Errorf("%v: output '%v' conflicts with asset manifest of hashed files", templateFile.InputPath, assetManifestName)
+		}
+	}
+	return nil
+}
+
+func (tx *TemplateContext) saveAssetManifest(dir string, manifest []byte) error {
+	if manifest == nil {
+		return nil
+	}
+	path := joinOutput(dir, assetManifestName)
+	if isS3URL(path) {
+		_, err := tx.s3.Put(path, manifest)
+		return err
+	}
+	return os.WriteFile(path, manifest, 0664)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunAssets(t *testing.T) {
+	hashed := "{{/*---\nhashName: true\n---*/}}\n"
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name: "plain file refers hashed file",
+			files: map[string]string{
+				"in/app.js":      hashed + "app",
+				"in/index.html":  `{{ asset "app.js" }}`,
+				"in/favicon.txt": "icon",
+			},
+		},
+		{
+			name: "output conflicts with manifest",
+			files: map[string]string{
+				"in/app.js":        hashed + "app",
+				"in/manifest.json": `{"name": "pwa"}`,
+			},
+			wantErr: "conflicts with asset manifest",
+		},
+		{
+			name: "hashed file refers hashed file",
+			files: map[string]string{
+				"in/a.js": hashed + `{{ asset "b.js" }}`,
+				"in/b.js": hashed + "b",
+			},
+			wantErr: "can't be referred from hashed file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+			writeFiles(t, dir, tt.files)
+			flags, err := NewFlags([]string{"-id", in, "-od", out})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Run(flags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want error %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			index, err := os.ReadFile(filepath.Join(out, "index.html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(out, string(index))); err != nil {
+				t.Errorf("asset %q is not saved: %v", index, err)
+			}
+			if _, err := os.Stat(filepath.Join(out, assetManifestName)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Layer conflicts
+//
+// Variables come from layers: environment, env files given by -ef in order,
+// then env files of dir manifests. Every value is recorded with its layer, so
+// keys defined in several layers can be reported.
+const environmentLayer = "environment"
+
+type envSource struct {
+	Layer string
+	Value string
+}
+
+type Conflict struct {
+	Name    string
+	Sources []envSource
+	// Differ is true when layers define different values, so the last one
+	// shadows others
+	Differ bool
+}
+
+func (tx *TemplateContext) setEnv(layer, name, value string) {
+	if tx.sources == nil {
+		tx.sources = map[string][]envSource{}
+	}
+	tx.envs[name] = value
+	tx.sources[name] = append(tx.sources[name], envSource{layer, value})
+}
+
+// Conflicts returns keys defined in several layers of contexts, sorted by name
+func Conflicts(contexts ...*TemplateContext) []Conflict {
+	conflicts := []Conflict{}
+	seen := map[string]bool{}
+	for _, tx := range contexts {
+		for name, sources := range tx.sources {
+			if len(sources) < 2 {
+				continue
+			}
+			c := Conflict{Name: name, Sources: sources}
+			layers := []string{}
+			for _, source := range sources {
+				layers = append(layers, source.Layer)
+				c.Differ = c.Differ || source.Value != sources[0].Value
+			}
+			// subtree contexts repeat conflicts of base one
+			key := name + "\x00" + strings.Join(layers, "\x00")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			conflicts = append(conflicts, c)
+		}
+	}
+	sort.SliceStable(conflicts, func(i, j int) bool { return conflicts[i].Name < conflicts[j].Name })
+	return conflicts
+}
+
+// Describe returns sources of conflict with values redacted by r
+func (c Conflict) Describe(r *Redactor) string {
+	sources := []string{}
+	for _, source := range c.Sources {
+		sources = append(sources, source.Layer+"="+r.Display(c.Name, source.Value))
+	}
+	state := "same value"
+	if c.Differ {
+		state = "differs"
+	}
+	return fmt.Sprintf("%v: %v (%v)", c.Name, strings.Join(sources, " -> "), state)
+}
+
+// shadowed returns names of conflicts with different values not in allowlist
+func shadowed(conflicts []Conflict, allow string) []string {
+	allowed := map[string]bool{}
+	for _, name := range splitList(allow) {
+		allowed[name] = true
+	}
+	names := []string{}
+	for _, c := range conflicts {
+		if c.Differ && !allowed[c.Name] && (len(names) == 0 || names[len(names)-1] != c.Name) {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// contextsOf returns distinct contexts used by files, base context first
+func contextsOf(tx *TemplateContext, templateFiles []*TemplateFile) []*TemplateContext {
+	contexts := []*TemplateContext{tx}
+	seen := map[*TemplateContext]bool{tx: true}
+	for _, templateFile := range templateFiles {
+		if !seen[templateFile.TemplateContext] {
+			seen[templateFile.TemplateContext] = true
+			contexts = append(contexts, templateFile.TemplateContext)
+		}
+	}
+	return contexts
+}
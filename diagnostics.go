@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Template diagnostics
+//
+// warn, deprecated and fail let templates report problems:
+//
+//	{{ if eq (.Env "TLS") "off" }}{{ warn "TLS disabled in prod" }}{{ end }}
+//
+// Reports are collected per file and printed after all files are rendered.
+// Failures stop the run before anything is written, with -warnings-as-errors
+// warnings do too. Location of each call is added to its arguments when
+// template is parsed, so reports point to line of the call.
+const (
+	levelWarning    = "warning"
+	levelDeprecated = "deprecated"
+	levelError      = "error"
+)
+
+var diagnosticFuncs = map[string]string{
+	"warn":       levelWarning,
+	"deprecated": levelDeprecated,
+	"fail":       levelError,
+}
+
+type Diagnostic struct {
+	Level    string
+	Location string
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%v: %v: %v", d.Location, d.Level, d.Message)
+}
+
+func (tf *TemplateFile) diagnose(level string) func(location, message string) string {
+	return func(location, message string) string {
+		d := Diagnostic{level, location, message}
+		// calls in loops report once
+		for _, reported := range tf.Diagnostics {
+			if reported == d {
+				return ""
+			}
+		}
+		tf.Diagnostics = append(tf.Diagnostics, d)
+		return ""
+	}
+}
+
+// annotate adds location of call as first argument of diagnostic functions
+func annotate(t *template.Template) {
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			annotateNode(tmpl.Tree, tmpl.Tree.Root)
+		}
+	}
+}
+
+func annotateNode(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			annotateNode(tree, child)
+		}
+	case *parse.ActionNode:
+		annotateNode(tree, n.Pipe)
+	case *parse.TemplateNode:
+		annotateNode(tree, n.Pipe)
+	case *parse.IfNode:
+		annotateBranch(tree, &n.BranchNode)
+	case *parse.RangeNode:
+		annotateBranch(tree, &n.BranchNode)
+	case *parse.WithNode:
+		annotateBranch(tree, &n.BranchNode)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			annotateNode(tree, cmd)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			annotateNode(tree, arg)
+		}
+		ident, ok := n.Args[0].(*parse.IdentifierNode)
+		if !ok || diagnosticFuncs[ident.Ident] == "" {
+			return
+		}
+		location, _ := tree.ErrorContext(n)
+		// drop column
+		if i := strings.LastIndex(location, ":"); i != -1 {
+			location = location[:i]
+		}
+		arg := &parse.StringNode{NodeType: parse.NodeString, Pos: n.Pos, Quoted: strconv.Quote(location), Text: location}
+		n.Args = append([]parse.Node{n.Args[0], arg}, n.Args[1:]...)
+	}
+}
+
+func annotateBranch(tree *parse.Tree, n *parse.BranchNode) {
+	annotateNode(tree, n.Pipe)
+	annotateNode(tree, n.List)
+	annotateNode(tree, n.ElseList)
+}
+
+// reportDiagnostics prints diagnostics of all files, returning error when
+// some of them fail the run
+func reportDiagnostics(templateFiles []*TemplateFile, warningsAsErrors bool) error {
+	failures := 0
+	for _, templateFile := range templateFiles {
+		for _, d := range templateFile.Diagnostics {
+			log.Println(d)
+			if d.Level == levelError || warningsAsErrors {
+				failures++
+			}
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("Templates reported %v failures", failures)
+	}
+	return nil
+}
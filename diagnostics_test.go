@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// renderDiagnostics renders input with list function returning n items and
+// returns reported diagnostics
+func renderDiagnostics(t *testing.T, input string) []Diagnostic {
+	t.Helper()
+	tf := newTestFile(input, nil)
+	list := template.FuncMap{"list": func(n int) []int { return make([]int, n) }}
+	templater, err := tf.newTemplate(tf.InputPath).Funcs(list).Parse(tf.Input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotate(templater)
+	tf.templater = templater
+	err = tf.Template()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf.Diagnostics
+}
+
+func TestDiagnosticLocations(t *testing.T) {
+	input := `{{ warn "top" }}
+{{ if true }}
+  {{ deprecated "in if" }}
+{{ else }}{{ end }}
+{{ range list 3 }}
+  {{ warn "in range" }}
+{{ end }}
+{{ define "part" }}
+  {{ fail "in define" }}
+{{ end }}
+{{ template "part" }}
+{{ "piped" | warn }}
+{{ with "x" }}{{ printf "%v in with" . | deprecated }}{{ end }}`
+	want := []Diagnostic{
+		{levelWarning, "test.tmpl:1", "top"},
+		{levelDeprecated, "test.tmpl:3", "in if"},
+		{levelWarning, "test.tmpl:6", "in range"},
+		{levelError, "test.tmpl:9", "in define"},
+		{levelWarning, "test.tmpl:12", "piped"},
+		{levelDeprecated, "test.tmpl:13", "x in with"},
+	}
+	if got := renderDiagnostics(t, input); !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDiagnosticsInLoops(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		// the same call reports once
+		{`{{ range list 5 }}{{ warn "same" }}{{ end }}`, 1},
+		// different messages of the same call report each
+		{`{{ range $i, $_ := list 3 }}{{ warn (printf "item %v" $i) }}{{ end }}`, 3},
+		// the same message from different lines reports each
+		{"{{ warn \"same\" }}\n{{ warn \"same\" }}", 2},
+	}
+	for _, tt := range tests {
+		if got := renderDiagnostics(t, tt.input); len(got) != tt.want {
+			t.Errorf("%v: got %v, want %v reports", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRunDiagnostics(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		args    []string
+		wantErr bool
+	}{
+		{
+			name:  "warning does not fail",
+			files: map[string]string{"in/a.conf": `{{ warn "old" }}a`, "in/b.conf": "b"},
+		},
+		{
+			name:    "warnings as errors",
+			files:   map[string]string{"in/a.conf": `{{ warn "old" }}a`, "in/b.conf": "b"},
+			args:    []string{"-warnings-as-errors"},
+			wantErr: true,
+		},
+		{
+			name:    "fail in later file stops run",
+			files:   map[string]string{"in/a.conf": "a", "in/sub/b.conf": `{{ if true }}{{ fail "broken" }}{{ end }}b`},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+			writeFiles(t, dir, tt.files)
+			flags, err := NewFlags(append([]string{"-id", in, "-od", out}, tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Run(flags)
+			written, _ := recursiveGetFiles(out)
+			if !tt.wantErr {
+				if err != nil || len(written) != 2 {
+					t.Errorf("got %v, written %v", err, written)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "reported 1 failures") {
+				t.Errorf("got %v, want failures error", err)
+			}
+			if len(written) > 0 {
+				t.Errorf("files are written before failure: %v", written)
+			}
+		})
+	}
+}
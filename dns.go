@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS lookups
+//
+// dnsSRV, dnsA and dnsTXT build values from DNS, e.g. list of upstreams:
+//
+//	{{ range dnsSRV "_http._tcp.api.svc" }}server {{ .Target }}:{{ .Port }};
+//	{{ end }}
+//
+// Results are sorted, so output does not change with order of answers, and
+// cached for the whole run. -dns-server points lookups to given server
+// instead of system resolver.
+const defaultDNSTimeout = 5 * time.Second
+
+type SRVRecord struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+type dnsResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]interface{}
+}
+
+func newDNSResolver(server string, timeout time.Duration) *dnsResolver {
+	r := &dnsResolver{
+		resolver: net.DefaultResolver,
+		timeout:  timeout,
+		cache:    map[string]interface{}{},
+	}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r
+}
+
+// lookup returns cached result of kind for name or calls f
+func (r *dnsResolver) lookup(kind, name string, f func(context.Context) (interface{}, int, error)) (interface{}, error) {
+	key := kind + " " + name
+	r.mu.Lock()
+	v, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	v, n, err := f(ctx)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		err, n = nil, 0
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed lookup %v records of '%v': %v", kind, name, err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("No %v records found for '%v'", kind, name)
+	}
+
+	r.mu.Lock()
+	r.cache[key] = v
+	r.mu.Unlock()
+	return v, nil
+}
+
+// SRV returns records sorted by priority, weight descending and target
+func (r *dnsResolver) SRV(name string) ([]SRVRecord, error) {
+	v, err := r.lookup("SRV", name, func(ctx context.Context) (interface{}, int, error) {
+		_, addrs, err := r.resolver.LookupSRV(ctx, "", "", name)
+		records := []SRVRecord{}
+		for _, addr := range addrs {
+			records = append(records, SRVRecord{
+				Target:   strings.TrimSuffix(addr.Target, "."),
+				Port:     addr.Port,
+				Priority: addr.Priority,
+				Weight:   addr.Weight,
+			})
+		}
+		sort.Slice(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			switch {
+			case a.Priority != b.Priority:
+				return a.Priority < b.Priority
+			case a.Weight != b.Weight:
+				return a.Weight > b.Weight
+			case a.Target != b.Target:
+				return a.Target < b.Target
+			}
+			return a.Port < b.Port
+		})
+		return records, len(records), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]SRVRecord), nil
+}
+
+// A returns sorted IPv4 addresses
+func (r *dnsResolver) A(name string) ([]string, error) {
+	v, err := r.lookup("A", name, func(ctx context.Context) (interface{}, int, error) {
+		ips, err := r.resolver.LookupIP(ctx, "ip4", name)
+		sort.Slice(ips, func(i, j int) bool { return string(ips[i].To4()) < string(ips[j].To4()) })
+		addrs := []string{}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		return addrs, len(addrs), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]string), nil
+}
+
+// TXT returns sorted texts
+func (r *dnsResolver) TXT(name string) ([]string, error) {
+	v, err := r.lookup("TXT", name, func(ctx context.Context) (interface{}, int, error) {
+		texts, err := r.resolver.LookupTXT(ctx, name)
+		sort.Strings(texts)
+		return texts, len(texts), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]string), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+)
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+// fakeDNS answers queries over UDP with fixed records, unknown names get
+// NXDOMAIN
+type fakeDNS struct {
+	conn    net.PacketConn
+	records map[dnsQuestion][][]byte
+
+	mu      sync.Mutex
+	queries map[dnsQuestion]int
+}
+
+func dnsName(name string) []byte {
+	b := []byte{}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func dnsSRVData(priority, weight, port uint16, target string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, priority)
+	b = binary.BigEndian.AppendUint16(b, weight)
+	b = binary.BigEndian.AppendUint16(b, port)
+	return append(b, dnsName(target)...)
+}
+
+func dnsTXTData(text string) []byte {
+	return append([]byte{byte(len(text))}, text...)
+}
+
+func newFakeDNS(t *testing.T, records map[dnsQuestion][][]byte) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &fakeDNS{conn: conn, records: records, queries: map[dnsQuestion]int{}}
+	go s.serve()
+	return s
+}
+
+func (s *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if out := s.answer(buf[:n]); out != nil {
+			s.conn.WriteTo(out, addr)
+		}
+	}
+}
+
+func (s *fakeDNS) answer(query []byte) []byte {
+	labels := []string{}
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		labels = append(labels, string(query[i+1:i+1+int(query[i])]))
+		i += 1 + int(query[i])
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	q := dnsQuestion{strings.ToLower(strings.Join(labels, ".")), binary.BigEndian.Uint16(query[i+1:])}
+
+	s.mu.Lock()
+	s.queries[q]++
+	s.mu.Unlock()
+
+	rcode := uint16(3)
+	for known := range s.records {
+		if known.name == q.name {
+			rcode = 0
+		}
+	}
+	records := s.records[q]
+
+	out := append([]byte{}, query[:2]...)
+	for _, v := range []uint16{0x8180 | rcode, 1, uint16(len(records)), 0, 0} {
+		out = binary.BigEndian.AppendUint16(out, v)
+	}
+	out = append(out, query[12:i+5]...)
+	for _, data := range records {
+		// name is pointer to question
+		out = append(out, 0xc0, 0x0c)
+		out = binary.BigEndian.AppendUint16(out, q.qtype)
+		out = binary.BigEndian.AppendUint16(out, 1)
+		out = binary.BigEndian.AppendUint32(out, 60)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(data)))
+		out = append(out, data...)
+	}
+	return out
+}
+
+func (s *fakeDNS) count(q dnsQuestion) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[q]
+}
+
+var testDNSRecords = map[dnsQuestion][][]byte{
+	{"_http._tcp.api.svc", dnsTypeSRV}: {
+		dnsSRVData(20, 5, 80, "b.svc"),
+		dnsSRVData(10, 5, 8080, "a.svc"),
+		dnsSRVData(10, 50, 81, "c.svc"),
+	},
+	{"api.svc", dnsTypeA}:   {{10, 0, 0, 2}, {10, 0, 0, 1}},
+	{"api.svc", dnsTypeTXT}: {dnsTXTData("zeta"), dnsTXTData("alpha")},
+}
+
+func TestDNSResolver(t *testing.T) {
+	server := newFakeDNS(t, testDNSRecords)
+	r := newDNSResolver(server.conn.LocalAddr().String(), time.Second)
+
+	srv, err := r.SRV("_http._tcp.api.svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSRV := []SRVRecord{{"c.svc", 81, 10, 50}, {"a.svc", 8080, 10, 5}, {"b.svc", 80, 20, 5}}
+	if !reflect.DeepEqual(srv, wantSRV) {
+		t.Errorf("SRV: got %v, want %v", srv, wantSRV)
+	}
+
+	a, err := r.A("api.svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(a, want) {
+		t.Errorf("A: got %v, want %v", a, want)
+	}
+
+	txt, err := r.TXT("api.svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alpha", "zeta"}; !reflect.DeepEqual(txt, want) {
+		t.Errorf("TXT: got %v, want %v", txt, want)
+	}
+
+	// results are cached for the whole run
+	_, err = r.A("api.svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := server.count(dnsQuestion{"api.svc", dnsTypeA}); n != 1 {
+		t.Errorf("got %v A queries, want 1", n)
+	}
+
+	_, err = r.A("missing.svc")
+	if err == nil || !strings.Contains(err.Error(), "No A records found for 'missing.svc'") {
+		t.Errorf("missing name: got %v", err)
+	}
+	_, err = r.TXT("_http._tcp.api.svc")
+	if err == nil || !strings.Contains(err.Error(), "No TXT records found") {
+		t.Errorf("name without records of type: got %v", err)
+	}
+}
+
+func TestDNSResolverTimeout(t *testing.T) {
+	// server, which never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := newDNSResolver(conn.LocalAddr().String(), 100*time.Millisecond)
+	start := time.Now()
+	_, err = r.A("api.svc")
+	if err == nil || !strings.Contains(err.Error(), "Failed lookup A records of 'api.svc'") {
+		t.Errorf("got %v, want failed lookup", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("lookup took %v", elapsed)
+	}
+}
+
+func TestRunDNSServer(t *testing.T) {
+	server := newFakeDNS(t, testDNSRecords)
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	writeFiles(t, dir, map[string]string{
+		"in/upstream.conf": `{{ range dnsSRV "_http._tcp.api.svc" }}server {{ .Target }}:{{ .Port }};
+{{ end }}`,
+	})
+
+	flags, err := NewFlags([]string{"-id", in, "-od", out, "-dns-server", server.conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Run(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(out, "upstream.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "server c.svc:81;\nserver a.svc:8080;\nserver b.svc:80;\n"
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
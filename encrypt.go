@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted outputs
+//
+// File with "encrypt: true" in front matter is encrypted for recipient
+// before saving and gets .enc suffix. Recipient is X25519 public key given by
+// "recipient" in front matter or -recipient flag, either as base64 of raw key
+// or as path to PEM file. Content is encrypted with AES-256-GCM using key
+// derived from ephemeral X25519 key exchange:
+//
+//	magic | ephemeral public key (32) | nonce (12) | ciphertext
+const (
+	encryptedMagic  = "envtemplater-enc-v1\n"
+	encryptedSuffix = ".enc"
+)
+
+func (tf *TemplateFile) Encrypt() bool {
+	return tf.FrontMatter["encrypt"] == "true"
+}
+
+func (tf *TemplateFile) encryptOutput(defaultRecipient string) error {
+	recipient := tf.FrontMatter["recipient"]
+	if recipient == "" {
+		recipient = defaultRecipient
+	}
+	if recipient == "" {
+		return fmt.Errorf("%v: encrypt requires recipient", tf.InputPath)
+	}
+	if tf.OutputMode != "template" && tf.OutputMode != "" {
+		return fmt.Errorf("%v: encrypt is not supported in %v output mode", tf.InputPath, tf.OutputMode)
+	}
+
+	pub, err := loadPublicKey(recipient)
+	if err != nil {
+		return fmt.Errorf("%v: %v", tf.InputPath, err)
+	}
+	b, err := encryptFor(pub, []byte(tf.Output))
+	if err != nil {
+		return err
+	}
+	tf.Output = string(b)
+	tf.OutputPath += encryptedSuffix
+	return nil
+}
+
+func encryptionKey(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptFor(pub *ecdh.PublicKey, plaintext []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(encryptionKey(shared, ephemeral.PublicKey().Bytes(), pub.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []byte(encryptedMagic)
+	out = append(out, ephemeral.PublicKey().Bytes()...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, []byte(encryptedMagic)), nil
+}
+
+func decryptWith(priv *ecdh.PrivateKey, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptedMagic)) {
+		return nil, fmt.Errorf("Not encrypted by envtemplater")
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < 32+12 {
+		return nil, fmt.Errorf("Encrypted data is truncated")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(encryptionKey(shared, ephemeral.Bytes(), priv.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[32 : 32+aead.NonceSize()]
+	return aead.Open(nil, nonce, data[32+aead.NonceSize():], []byte(encryptedMagic))
+}
+
+// readKey returns raw key from base64 value or DER block of PEM file
+func readKey(value string) ([]byte, bool, error) {
+	if raw, err := base64.StdEncoding.DecodeString(value); err == nil && len(raw) == 32 {
+		return raw, false, nil
+	}
+	b, err := os.ReadFile(value)
+	if err != nil {
+		return nil, false, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(raw) != 32 {
+			return nil, false, fmt.Errorf("Key file '%v' is neither PEM nor base64 X25519 key", value)
+		}
+		return raw, false, nil
+	}
+	return block.Bytes, true, nil
+}
+
+func loadPublicKey(value string) (*ecdh.PublicKey, error) {
+	b, der, err := readKey(value)
+	if err != nil {
+		return nil, err
+	}
+	if !der {
+		return ecdh.X25519().NewPublicKey(b)
+	}
+	key, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*ecdh.PublicKey)
+	if !ok || pub.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("Key '%v' is not X25519 public key", value)
+	}
+	return pub, nil
+}
+
+func loadPrivateKey(value string) (*ecdh.PrivateKey, error) {
+	b, der, err := readKey(value)
+	if err != nil {
+		return nil, err
+	}
+	if !der {
+		return ecdh.X25519().NewPrivateKey(b)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdh.PrivateKey)
+	if !ok || priv.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("Key '%v' is not X25519 private key", value)
+	}
+	return priv, nil
+}
+
+// DecryptOutputs implements decrypt-outputs subcommand. It decrypts single
+// file or every .enc file in dir, writing result next to it without suffix.
+func DecryptOutputs(args []string) error {
+	var key, file, dir string
+	var remove bool
+	flagSet := flag.NewFlagSet("envtemplater decrypt-outputs", flag.ContinueOnError)
+	flagSet.StringVar(&key, "key", "", "X25519 private key, base64 or PEM file")
+	flagSet.StringVar(&file, "if", "", "Encrypted file")
+	flagSet.StringVar(&dir, "id", "", "Dir with encrypted files")
+	flagSet.BoolVar(&remove, "rm", false, "Remove encrypted files after decrypt")
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case key == "":
+		return fmt.Errorf("Required private key")
+	case file == "" && dir == "":
+		return fmt.Errorf("Required input file or input dir")
+	case file != "" && !strings.HasSuffix(file, encryptedSuffix):
+		// plaintext is written next to input without the suffix
+		return fmt.Errorf("Input file '%v' must have '%v' suffix", file, encryptedSuffix)
+	}
+
+	priv, err := loadPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	files := []string{file}
+	if dir != "" {
+		files = []string{}
+		names, err := recursiveGetFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if strings.HasSuffix(name, encryptedSuffix) {
+				files = append(files, filepath.Join(dir, name))
+			}
+		}
+	}
+
+	for _, path := range files {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		plaintext, err := decryptWith(priv, b)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		err = writeFileAtomic(strings.TrimSuffix(path, encryptedSuffix), plaintext, 0600)
+		if err != nil {
+			return err
+		}
+		if remove {
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
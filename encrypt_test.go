@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecryptOutputs(t *testing.T) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.StdEncoding.EncodeToString(priv.Bytes())
+	data, err := encryptFor(priv.PublicKey(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "app.conf.enc")
+	copied := filepath.Join(dir, "copyfile")
+	writeFiles(t, dir, map[string]string{"app.conf.enc": string(data), "copyfile": string(data)})
+
+	// input without suffix would be overwritten and removed
+	err = DecryptOutputs([]string{"-key", key, "-if", copied, "-rm"})
+	if err == nil {
+		t.Error("expected error for input without suffix")
+	}
+	if b, err := os.ReadFile(copied); err != nil || string(b) != string(data) {
+		t.Errorf("input without suffix was changed: %v", err)
+	}
+
+	err = DecryptOutputs([]string{"-key", key, "-if", encrypted, "-rm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "app.conf"))
+	if err != nil || string(b) != "secret" {
+		t.Errorf("got %q, %v", b, err)
+	}
+	if _, err := os.Stat(encrypted); !os.IsNotExist(err) {
+		t.Errorf("encrypted file was not removed: %v", err)
+	}
+
+	// other key fails authentication
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if _, err := decryptWith(other, data); err == nil {
+		t.Error("expected error decrypting with other key")
+	}
+}
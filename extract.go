@@ -0,0 +1,353 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template/parse"
+)
+
+// Extract values
+//
+// extract subcommand guesses values of variables from a file written by
+// hand. Template is split into lines, each line becomes a pattern where
+// literal text must match exactly and {{ .Env "NAME" }} captures value of
+// NAME. Lines with other actions match anything in place of the action,
+// lines with if, range and other blocks match any number of lines.
+//
+// Template lines are aligned with lines of the file by longest common
+// subsequence, values are taken from aligned lines and written as draft env
+// file. Lines of the file matched by nothing are reported.
+type extractLine struct {
+	// line of template
+	line int
+	re   *regexp.Regexp
+	// vars holds variable of each capture group
+	vars []string
+	refs []string
+	// block is set for lines matching any number of lines
+	block bool
+}
+
+type extractToken struct {
+	text  string
+	pos   int
+	env   string
+	block bool
+	any   bool
+	// refs holds variables used by action or block, which are not solved
+	refs []string
+}
+
+var envRefRe = regexp.MustCompile(`\.Env\s+"([^"]+)"`)
+
+func envRefs(node parse.Node) []string {
+	refs := []string{}
+	for _, m := range envRefRe.FindAllStringSubmatch(node.String(), -1) {
+		refs = append(refs, m[1])
+	}
+	return refs
+}
+
+// envName returns NAME of {{ .Env "NAME" }} action
+func envName(node *parse.ActionNode) (string, bool) {
+	pipe := node.Pipe
+	if len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 2 {
+		return "", false
+	}
+	args := pipe.Cmds[0].Args
+	var ident []string
+	switch n := args[0].(type) {
+	case *parse.FieldNode:
+		ident = n.Ident
+	case *parse.VariableNode:
+		if len(n.Ident) > 0 && n.Ident[0] == "$" {
+			ident = n.Ident[1:]
+		}
+	}
+	name, ok := args[1].(*parse.StringNode)
+	if len(ident) != 1 || ident[0] != "Env" || !ok {
+		return "", false
+	}
+	return name.Text, true
+}
+
+func extractTokens(nodes []parse.Node) []extractToken {
+	tokens := []extractToken{}
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			tokens = append(tokens, extractToken{text: string(n.Text), pos: int(n.Pos)})
+		case *parse.CommentNode:
+		case *parse.ActionNode:
+			if name, ok := envName(n); ok {
+				tokens = append(tokens, extractToken{env: name, pos: int(n.Pos)})
+			} else {
+				tokens = append(tokens, extractToken{any: true, pos: int(n.Pos), refs: envRefs(n)})
+			}
+		default:
+			tokens = append(tokens, extractToken{block: true, pos: int(node.Position()), refs: envRefs(n)})
+		}
+	}
+	return tokens
+}
+
+// extractLines splits template into line patterns. Block is a line of its
+// own, text around it on the same line forms separate lines.
+func extractLines(input string, root *parse.ListNode) ([]*extractLine, error) {
+	lineOf := func(pos int) int {
+		return strings.Count(input[:min(pos, len(input))], "\n") + 1
+	}
+
+	lines := []*extractLine{}
+	pattern := new(strings.Builder)
+	current := &extractLine{line: 1}
+	afterBlock := false
+	flush := func(next int) error {
+		if pattern.Len() > 0 || len(current.vars) > 0 || !afterBlock {
+			re, err := regexp.Compile("^" + pattern.String() + "$")
+			if err != nil {
+				return err
+			}
+			current.re = re
+			lines = append(lines, current)
+		}
+		pattern.Reset()
+		current = &extractLine{line: lineOf(next)}
+		afterBlock = false
+		return nil
+	}
+
+	for _, token := range extractTokens(root.Nodes) {
+		current.refs = append(current.refs, token.refs...)
+		switch {
+		case token.env != "":
+			pattern.WriteString("(.*?)")
+			current.vars = append(current.vars, token.env)
+		case token.any:
+			pattern.WriteString(".*?")
+		case token.block:
+			if pattern.Len() > 0 || len(current.vars) > 0 {
+				err := flush(token.pos)
+				if err != nil {
+					return nil, err
+				}
+			}
+			current.block = true
+			lines = append(lines, current)
+			current = &extractLine{line: current.line}
+			afterBlock = true
+		default:
+			parts := strings.Split(token.text, "\n")
+			offset := token.pos
+			for i, part := range parts {
+				if i > 0 {
+					err := flush(offset)
+					if err != nil {
+						return nil, err
+					}
+				}
+				pattern.WriteString(regexp.QuoteMeta(part))
+				offset += len(part) + 1
+			}
+		}
+	}
+	// output ending with newline has no last line
+	if pattern.Len() > 0 || len(current.vars) > 0 {
+		return lines, flush(len(input))
+	}
+	return lines, nil
+}
+
+// alignLines returns index of file line aligned with each template line, -1
+// for template lines aligned with nothing
+func alignLines(patterns []*extractLine, lines []string) []int {
+	n, m := len(patterns), len(lines)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case !patterns[i].block && patterns[i].re.MatchString(lines[j]):
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	aligned := make([]int, n)
+	i, j := 0, 0
+	for i < n {
+		switch {
+		case j < m && !patterns[i].block && patterns[i].re.MatchString(lines[j]) && lcs[i][j] == lcs[i+1][j+1]+1:
+			aligned[i] = j
+			i++
+			j++
+		case j < m && lcs[i][j+1] > lcs[i+1][j]:
+			j++
+		default:
+			aligned[i] = -1
+			i++
+		}
+	}
+	return aligned
+}
+
+type extractResult struct {
+	names  []string
+	values map[string]string
+	// problems holds reported lines and conflicting values
+	problems []string
+}
+
+func extract(input string, root *parse.ListNode, current string) (*extractResult, error) {
+	patterns, err := extractLines(input, root)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSuffix(current, "\n"), "\n")
+	aligned := alignLines(patterns, lines)
+
+	r := &extractResult{values: map[string]string{}}
+	seen := map[string]bool{}
+	// covered holds file lines matched by template line or block
+	covered := make([]bool, len(lines))
+	for i, pattern := range patterns {
+		for _, name := range append(pattern.vars, pattern.refs...) {
+			if !seen[name] {
+				seen[name] = true
+				r.names = append(r.names, name)
+			}
+		}
+		j := aligned[i]
+		if pattern.block {
+			continue
+		}
+		if j == -1 {
+			r.problems = append(r.problems, fmt.Sprintf("template line %v: not found", pattern.line))
+			continue
+		}
+		covered[j] = true
+
+		m := pattern.re.FindStringSubmatch(lines[j])
+		for k, name := range pattern.vars {
+			value := m[k+1]
+			if prev, ok := r.values[name]; ok && prev != value {
+				r.problems = append(r.problems, fmt.Sprintf("line %v: %v is '%v', earlier it was '%v'", j+1, name, value, prev))
+				continue
+			}
+			r.values[name] = value
+		}
+	}
+
+	// lines between neighbours of block are produced by block
+	for i, pattern := range patterns {
+		if !pattern.block {
+			continue
+		}
+		from, to := 0, len(lines)
+		for k := i - 1; k >= 0; k-- {
+			if aligned[k] != -1 && !patterns[k].block {
+				from = aligned[k] + 1
+				break
+			}
+		}
+		for k := i + 1; k < len(patterns); k++ {
+			if aligned[k] != -1 && !patterns[k].block {
+				to = aligned[k]
+				break
+			}
+		}
+		for j := from; j < to; j++ {
+			covered[j] = true
+		}
+	}
+	for j, line := range lines {
+		if !covered[j] {
+			r.problems = append(r.problems, fmt.Sprintf("line %v: unmatched '%v'", j+1, line))
+		}
+	}
+	return r, nil
+}
+
+// envFile returns draft env file, unsolved variables are commented out
+func (r *extractResult) envFile(source string) string {
+	buf := new(strings.Builder)
+	fmt.Fprintf(buf, "# Draft extracted from %v, review before use\n", source)
+	for _, name := range r.names {
+		if value, ok := r.values[name]; ok {
+			fmt.Fprintf(buf, "%v=%v\n", name, value)
+		} else {
+			fmt.Fprintf(buf, "# %v=\n", name)
+		}
+	}
+	return buf.String()
+}
+
+func Extract(args []string) error {
+	var input, output, envFile string
+	flagSet := flag.NewFlagSet("envtemplater extract", flag.ContinueOnError)
+	flagSet.StringVar(&input, "if", "", "Template")
+	flagSet.StringVar(&output, "of", "", "Existing file rendered by template")
+	flagSet.StringVar(&envFile, "ef", "", "Draft env file to write, stdout by default")
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+	if input == "" || output == "" {
+		return fmt.Errorf("Required input file and output file")
+	}
+
+	// existing file is required, missing one would match nothing
+	_, err = os.Stat(output)
+	if err != nil {
+		return err
+	}
+
+	tx := NewTemplateContext()
+	flags := Flags{IF: input}
+	err = resolveRemoteInput(tx, &flags)
+	if err != nil {
+		return err
+	}
+	tf := NewTemplateFile(tx, input, input, output)
+	tf.Settings = defaultDirSettings()
+	err = tf.LoadInput()
+	if err == nil {
+		err = tf.LoadCurrent()
+	}
+	if err == nil {
+		err = tf.Parse()
+	}
+	if err != nil {
+		return err
+	}
+	if tf.templater == nil {
+		return fmt.Errorf("Template '%v' is not rendered by template engine", input)
+	}
+
+	r, err := extract(tf.Input, tf.templater.Tree.Root, tf.Current)
+	if err != nil {
+		return err
+	}
+	for _, problem := range r.problems {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", output, problem)
+	}
+
+	draft := r.envFile(output)
+	if envFile == "" {
+		fmt.Print(draft)
+		return nil
+	}
+	if _, err := os.Stat(envFile); err == nil {
+		return fmt.Errorf("File '%v' already exists", envFile)
+	}
+	return os.WriteFile(envFile, []byte(draft), 0640)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestAlignLines(t *testing.T) {
+	line := func(expr string) *extractLine {
+		return &extractLine{re: regexp.MustCompile("^" + expr + "$")}
+	}
+	block := &extractLine{block: true}
+
+	tests := []struct {
+		name     string
+		patterns []*extractLine
+		lines    []string
+		want     []int
+	}{
+		{
+			name:     "same lines",
+			patterns: []*extractLine{line("a"), line("b")},
+			lines:    []string{"a", "b"},
+			want:     []int{0, 1},
+		},
+		{
+			name:     "extra lines in file",
+			patterns: []*extractLine{line("a"), line("c")},
+			lines:    []string{"a", "b", "c", "d"},
+			want:     []int{0, 2},
+		},
+		{
+			name:     "template line missing in file",
+			patterns: []*extractLine{line("a"), line("b"), line("c")},
+			lines:    []string{"a", "c"},
+			want:     []int{0, -1, 1},
+		},
+		{
+			name:     "pattern matching several lines takes the first",
+			patterns: []*extractLine{line("x=.*"), line("end")},
+			lines:    []string{"x=1", "x=2", "end"},
+			want:     []int{0, 2},
+		},
+		{
+			name:     "lines out of order keep longest subsequence",
+			patterns: []*extractLine{line("a"), line("b"), line("c")},
+			lines:    []string{"b", "c", "a"},
+			want:     []int{-1, 0, 1},
+		},
+		{
+			name:     "block is aligned with nothing",
+			patterns: []*extractLine{line("a"), block, line("z")},
+			lines:    []string{"a", "x", "y", "z"},
+			want:     []int{0, -1, 3},
+		},
+		{
+			name:     "empty file",
+			patterns: []*extractLine{line("a")},
+			lines:    []string{},
+			want:     []int{-1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := alignLines(tt.patterns, tt.lines)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		current  string
+		values   map[string]string
+		problems []string
+	}{
+		{
+			name:    "values on lines",
+			input:   "host = {{ .Env \"HOST\" }}\nport = {{ .Env \"PORT\" }}\n",
+			current: "host = db\nport = 5432\n",
+			values:  map[string]string{"HOST": "db", "PORT": "5432"},
+		},
+		{
+			name:    "several values on line",
+			input:   `url = {{ .Env "SCHEME" }}://{{ .Env "HOST" }}:{{ .Env "PORT" }}`,
+			current: "url = https://db:5432",
+			values:  map[string]string{"SCHEME": "https", "HOST": "db", "PORT": "5432"},
+		},
+		{
+			name:     "conflicting values",
+			input:    "a = {{ .Env \"A\" }}\nb = {{ .Env \"A\" }}\n",
+			current:  "a = 1\nb = 2\n",
+			values:   map[string]string{"A": "1"},
+			problems: []string{"line 2: A is '2', earlier it was '1'"},
+		},
+		{
+			name:    "block covers lines between neighbours",
+			input:   "[upstream]\n{{ range $i := until 3 }}server {{ $i }}\n{{ end }}port = {{ .Env \"PORT\" }}\n",
+			current: "[upstream]\nserver 0\nserver 1\nport = 80\n",
+			values:  map[string]string{"PORT": "80"},
+		},
+		{
+			name:     "unmatched lines are reported",
+			input:    "a = {{ .Env \"A\" }}\nb = 2\n",
+			current:  "a = 1\nc = 3\n",
+			values:   map[string]string{"A": "1"},
+			problems: []string{"template line 2: not found", "line 2: unmatched 'c = 3'"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl, err := template.New(tt.name).Funcs(template.FuncMap{"until": func(int) []int { return nil }}).Parse(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := extract(tt.input, tpl.Tree.Root, tt.current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r.values, tt.values) {
+				t.Errorf("values: got %v, want %v", r.values, tt.values)
+			}
+			if !reflect.DeepEqual(r.problems, tt.problems) {
+				t.Errorf("problems: got %q, want %q", r.problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestExtractCommand(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`port = {{ .Env "PORT" }}` + "\n"))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.tmpl": `port = {{ .Env "PORT" }}` + "\n",
+		"app.conf": "port = 8080\n",
+	})
+
+	tests := []struct {
+		name    string
+		input   string
+		output  string
+		wantErr bool
+	}{
+		{"local template", filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "app.conf"), false},
+		{"template by url", server.URL + "/app.tmpl", filepath.Join(dir, "app.conf"), false},
+		{"missing file", filepath.Join(dir, "app.tmpl"), filepath.Join(dir, "missing.conf"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envFile := filepath.Join(t.TempDir(), "draft.env")
+			err := Extract([]string{"-if", tt.input, "-of", tt.output, "-ef", envFile})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(envFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), "\nPORT=8080\n") {
+				t.Errorf("got draft %q", b)
+			}
+		})
+	}
+}
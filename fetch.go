@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Remote templates
+//
+// Input file may be http(s) url of template, input dir may be url of tar
+// (optionally gzipped) archive. Fetched content is cached and revalidated with
+// ETag and Last-Modified, cached copy is used when server is unreachable,
+// but not when server answers with error.
+func isHTTPURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "envtemplater")
+}
+
+type fetcher struct {
+	dir string
+	// checksum is expected "sha256:<hex>" of fetched content, may be empty
+	checksum string
+	http     *http.Client
+}
+
+type cacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+}
+
+func newFetcher(dir, checksum string) (*fetcher, error) {
+	if checksum != "" && !strings.HasPrefix(checksum, "sha256:") {
+		return nil, fmt.Errorf("Unsupported checksum '%v', expected sha256:<hex>", checksum)
+	}
+	if dir == "" {
+		dir = defaultCacheDir()
+	}
+	return &fetcher{
+		dir:      dir,
+		checksum: checksum,
+		http:     &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (f *fetcher) cachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:]))
+}
+
+// Fetch returns content at url, revalidating cached copy
+func (f *fetcher) Fetch(url string) ([]byte, error) {
+	path := f.cachePath(url)
+	meta := cacheMeta{}
+	cached, cacheErr := os.ReadFile(path + ".body")
+	if cacheErr == nil {
+		b, err := os.ReadFile(path + ".json")
+		if err == nil {
+			json.Unmarshal(b, &meta)
+		}
+	}
+
+	// cached copy replaces unreachable server, not content removed or
+	// denied by server
+	body, err := f.get(url, cached != nil, &meta)
+	var status *statusError
+	switch {
+	case err != nil && cacheErr == nil && !errors.As(err, &status):
+		log.Printf("Using cached copy of %v: %v\n", url, err)
+		body = cached
+	case err != nil:
+		return nil, err
+	case body == nil:
+		body = cached
+	default:
+		err = f.store(path, body, meta)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, f.verify(url, body)
+}
+
+// statusError is answer of server other than 200 or 304
+type statusError struct {
+	url    string
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Failed fetch %v: %v", e.url, e.status)
+}
+
+// get returns nil body when cached copy is still valid
+func (f *fetcher) get(url string, cached bool, meta *cacheMeta) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached && meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if cached && meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, &statusError{url, resp.Status}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	*meta = cacheMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	return body, nil
+}
+
+func (f *fetcher) store(path string, body []byte, meta cacheMeta) error {
+	err := os.MkdirAll(f.dir, 0775)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(path+".body", body, 0664)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".json", b, 0664)
+}
+
+func (f *fetcher) verify(url string, body []byte) error {
+	if f.checksum == "" {
+		return nil
+	}
+	sum := sha256.Sum256(body)
+	if "sha256:"+hex.EncodeToString(sum[:]) != f.checksum {
+		return fmt.Errorf("Checksum of %v does not match %v", url, f.checksum)
+	}
+	return nil
+}
+
+// FetchTree extracts archive at url into cache and returns its dir. When
+// archive holds single top level dir, the dir is returned.
+func (f *fetcher) FetchTree(url string) (string, error) {
+	body, err := f.Fetch(url)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	dir := filepath.Join(f.dir, "trees", hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(dir); err != nil {
+		err = f.extractTree(url, body, dir)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dir, entries[0].Name()), nil
+	}
+	return dir, nil
+}
+
+func (f *fetcher) extractTree(url string, body []byte, dir string) error {
+	// extract to temp dir first, so broken archive never looks extracted
+	err := os.MkdirAll(filepath.Dir(dir), 0775)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".extract-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	err = extractTar(body, tmp)
+	if err != nil {
+		return fmt.Errorf("Failed extract %v: %v", url, err)
+	}
+	return os.Rename(tmp, dir)
+}
+
+func extractTar(body []byte, dir string) error {
+	var r io.Reader = bytes.NewReader(body)
+	if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("Unsafe path '%v' in archive", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0775)
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(path), 0775)
+			if err == nil {
+				var b []byte
+				b, err = io.ReadAll(tr)
+				if err == nil {
+					err = os.WriteFile(path, b, 0664)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// resolveRemoteInput prepares fetching of remote templates for flags
+func resolveRemoteInput(tx *TemplateContext, flags *Flags) error {
+	if !isHTTPURL(flags.IF) && !isHTTPURL(flags.ID) {
+		return nil
+	}
+	var err error
+	tx.fetcher, err = newFetcher(flags.CacheDir, flags.Checksum)
+	if err != nil {
+		return err
+	}
+	if isHTTPURL(flags.ID) {
+		flags.ID, err = tx.fetcher.FetchTree(flags.ID)
+	}
+	return err
+}
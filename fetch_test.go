@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFetchCache(t *testing.T) {
+	var mu sync.Mutex
+	status, body, etag := http.StatusOK, "v1", `"1"`
+	requests, revalidated := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if status != http.StatusOK {
+			http.Error(w, "error", status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	url := server.URL + "/app.conf"
+
+	f, err := newFetcher(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func() (string, error) {
+		b, err := f.Fetch(url)
+		return string(b), err
+	}
+
+	if got, err := fetch(); err != nil || got != "v1" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if got, err := fetch(); err != nil || got != "v1" || revalidated != 1 {
+		t.Fatalf("got %q, %v, %v revalidations", got, err, revalidated)
+	}
+
+	mu.Lock()
+	body, etag = "v2", `"2"`
+	mu.Unlock()
+	if got, err := fetch(); err != nil || got != "v2" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// removed or denied content is not replaced by cached copy
+	for _, code := range []int{http.StatusNotFound, http.StatusForbidden, http.StatusInternalServerError} {
+		mu.Lock()
+		status = code
+		mu.Unlock()
+		if got, err := fetch(); err == nil {
+			t.Errorf("%v: got %q, want error", code, got)
+		}
+	}
+
+	// unreachable server is replaced by cached copy
+	server.Close()
+	if got, err := fetch(); err != nil || got != "v2" {
+		t.Errorf("got %q, %v, want cached copy", got, err)
+	}
+
+	f.checksum = "sha256:0000"
+	if _, err := fetch(); err == nil {
+		t.Error("expected checksum error")
+	}
+}
+
+func TestRemoteInputHooks(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, content := range map[string]string{
+		manifestFileName: `hooks = ["true"]`,
+		"a.conf":         "a",
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0664, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	archive := buf.Bytes()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+	defer server.Close()
+	sum := sha256.Sum256(archive)
+
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{nil, true},
+		{[]string{"-checksum", "sha256:" + hex.EncodeToString(sum[:])}, false},
+		{[]string{"-allow-remote-hooks"}, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		args := append([]string{"-id", server.URL + "/t.tar", "-od", filepath.Join(dir, "out"), "-cache-dir", filepath.Join(dir, "cache")}, tt.args...)
+		flags, err := NewFlags(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Run(flags)
+		if tt.wantErr && (err == nil || !strings.Contains(err.Error(), "require -checksum")) {
+			t.Errorf("%v: got %v, want error", tt.args, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%v: %v", tt.args, err)
+		}
+	}
+}
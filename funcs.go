@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Template functions
+//
+// Functions available in every template. They are bound to the file being
+// rendered, so they can keep per-file state.
+func (tf *TemplateFile) funcMap() template.FuncMap {
+	funcs := template.FuncMap{
+		"changeCounter": func(name string) (string, error) {
+			return tf.counter(name, false)
+		},
+		"changeSerial": func(name string) (string, error) {
+			return tf.counter(name, true)
+		},
+		"asset":   tf.TemplateContext.asset,
+		"tpl":     tf.tpl,
+		guardFunc: tf.guard,
+		"dnsSRV":  tf.TemplateContext.dns.SRV,
+		"dnsA":    tf.TemplateContext.dns.A,
+		"dnsTXT":  tf.TemplateContext.dns.TXT,
+	}
+	for name, level := range diagnosticFuncs {
+		funcs[name] = tf.diagnose(level)
+	}
+	for name, f := range humanizeFuncs {
+		funcs[name] = f
+	}
+	if tf.TemplateContext.safe {
+		for _, name := range unsafeFuncs {
+			funcs[name] = deniedFunc(name)
+		}
+	}
+	return funcs
+}
+
+// Change counters
+//
+// Counter value depends on the rest of the output, so while rendering the
+// counter is written as placeholder, which is replaced by resolveCounters.
+func counterPlaceholder(name string) string {
+	return "\x00counter:" + name + "\x00"
+}
+
+func (tf *TemplateFile) counter(name string, dated bool) (string, error) {
+	state := tf.TemplateContext.state
+	if state == nil {
+		return "", fmt.Errorf("Counter '%v' requires state file", name)
+	}
+	if owner, ok := tf.TemplateContext.counterOwners[name]; ok && owner != tf.InputPath {
+		return "", fmt.Errorf("Counter '%v' is already used by '%v'", name, owner)
+	}
+	tf.TemplateContext.counterOwners[name] = tf.InputPath
+
+	if tf.counters == nil {
+		tf.counters = map[string]bool{}
+	}
+	tf.counters[name] = dated
+	return counterPlaceholder(name), nil
+}
+
+func (tf *TemplateFile) resolveCounters() {
+	if len(tf.counters) == 0 {
+		return
+	}
+	sum := sha256.Sum256([]byte(tf.Output))
+	hash := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	for name, dated := range tf.counters {
+		value := tf.TemplateContext.state.bumpCounter(name, hash, dated, now)
+		tf.Output = strings.ReplaceAll(tf.Output, counterPlaceholder(name), strconv.FormatInt(value, 10))
+	}
+}
+
+// Nested templates
+//
+// tpl renders a string, usually value of variable, as template with the same
+// data and functions as the file being rendered.
+const tplMaxDepth = 10
+
+func (tf *TemplateFile) tpl(snippet string) (string, error) {
+	name := tf.TemplateContext.origin(snippet)
+	if tf.tplDepth >= tplMaxDepth {
+		return "", fmt.Errorf("Snippet from %v exceeds tpl depth limit %v", name, tplMaxDepth)
+	}
+	tf.tplDepth++
+	defer func() { tf.tplDepth-- }()
+
+	templater, err := tf.newTemplate(name).Parse(snippet)
+	if err != nil {
+		return "", fmt.Errorf("Failed parse snippet from %v: %w", name, err)
+	}
+	annotate(templater)
+	buf := new(bytes.Buffer)
+	err = tf.execute(templater, buf)
+	if err != nil {
+		return "", fmt.Errorf("Failed execute snippet from %v: %w", name, err)
+	}
+	return buf.String(), nil
+}
+
+// origin returns name of variable value was read from, used to name snippets
+func (tx *TemplateContext) origin(value string) string {
+	if name, ok := tx.origins[value]; ok {
+		return name
+	}
+	return "snippet"
+}
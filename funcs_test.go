@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestFile returns file with given input and variables, without env of
+// the process
+func newTestFile(input string, envs map[string]string) *TemplateFile {
+	tx := NewTemplateContext()
+	tx.envs = map[string]string{}
+	for k, v := range envs {
+		tx.setEnv("test.env", k, v)
+	}
+	tf := NewTemplateFile(tx, "test.conf", "test.tmpl", "test.conf")
+	tf.Settings = defaultDirSettings()
+	tf.FrontMatter, tf.Input = parseFrontMatter(input)
+	return tf
+}
+
+func TestTplNamesSnippetByVariable(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`{{ tpl (.Env "B") }}`, "from B"},
+		{`{{ tpl (.Env "A") }}`, "from A"},
+		{`{{ tpl (printf "%v" (.Env "A")) }}`, "from A"},
+		{`{{ tpl (print (.Env "A") " ") }}`, "from snippet"},
+	}
+	for _, tt := range tests {
+		tf := newTestFile(tt.input, map[string]string{"A": "{{ .Broken", "B": "{{ .Broken"})
+		err := tf.Template()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want error %q", tt.input, err, tt.want)
+		}
+	}
+}
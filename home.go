@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Home mode
+//
+// In home mode input dir holds dotfiles. Path elements with "dot_" prefix
+// are renamed to start with ".", so dot_config/dot_gitconfig is rendered to
+// .config/.gitconfig. Output dir defaults to $HOME, with -users the input
+// dir is rendered into home of each listed user, owned by that user.
+//
+// Existing files not rendered by previous run are not managed by
+// envtemplater, they are backed up before being replaced.
+//
+// Home belongs to its user, who may replace any file or dir in it with
+// symlink to file of other user. Outputs are not written when any element of
+// their path below home is symlink, files are opened without following
+// symlinks and get mode and owner through opened file.
+const dotPrefix = "dot_"
+
+// dotName maps "dot_" prefixes of path elements to "."
+func dotName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, dotPrefix) {
+			parts[i] = "." + strings.TrimPrefix(part, dotPrefix)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// HomeUser is user whose home is rendered, available to templates as .User
+type HomeUser struct {
+	Name string
+	Home string
+	Uid  string
+	Gid  string
+}
+
+func homeUserOf(u *user.User) *HomeUser {
+	return &HomeUser{Name: u.Username, Home: u.HomeDir, Uid: u.Uid, Gid: u.Gid}
+}
+
+// currentHomeUser returns user running envtemplater, rendering into home
+func currentHomeUser(home string) *HomeUser {
+	hu := &HomeUser{Name: os.Getenv("USER"), Home: home}
+	if u, err := user.Current(); err == nil {
+		hu = homeUserOf(u)
+		hu.Home = home
+	}
+	return hu
+}
+
+// checkHomePath fails when path is outside of home or any of its elements
+// below home is symlink
+func checkHomePath(home, path string) error {
+	rel, err := filepath.Rel(home, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("'%v' is outside of home '%v'", path, home)
+	}
+	current := home
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("'%v' is a symlink, refusing to write through it in home mode", current)
+		}
+	}
+	return nil
+}
+
+// writeHomeFile writes file without following symlink in its place or
+// blocking on fifo, mode is changed when perm is not 0 and owner when uid is
+// not -1
+func writeHomeFile(path string, data []byte, perm os.FileMode, uid, gid int) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0664)
+	if err != nil {
+		return err
+	}
+	// hard link to file of other user is refused as well
+	info, err := f.Stat()
+	if err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); !info.Mode().IsRegular() || ok && stat.Nlink > 1 {
+			err = fmt.Errorf("'%v' is not a regular file or has several links, refusing to write it in home mode", path)
+		}
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil && perm != 0 {
+		err = f.Chmod(perm)
+	}
+	if err == nil && uid != -1 {
+		err = f.Chown(uid, gid)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// runUsers renders input dir into home of each user
+func runUsers(flags Flags, observer ...Observer) error {
+	notify := observers(observer)
+	for _, name := range splitList(flags.Users) {
+		start := time.Now()
+		u, err := user.Lookup(name)
+		if err == nil && u.HomeDir == "" {
+			err = fmt.Errorf("User '%v' has no home dir", name)
+		}
+		if err != nil {
+			return notify.failed("user", name, start, err)
+		}
+
+		userFlags := flags
+		userFlags.Users = ""
+		userFlags.OD = u.HomeDir
+		userFlags.user = homeUserOf(u)
+		if userFlags.Owner == "" {
+			userFlags.Owner = u.Uid + ":" + u.Gid
+		}
+		err = Run(userFlags, observer...)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// backupName returns free path to back up file at p
+func backupName(p string, now time.Time) string {
+	backup := p + ".envtemplater-backup-" + now.Format("20060102150405")
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(backup); os.IsNotExist(err) {
+			return backup
+		}
+		backup = fmt.Sprintf("%v.envtemplater-backup-%v.%v", p, now.Format("20060102150405"), i)
+	}
+}
+
+// backupUnmanaged copies existing file, which is not managed and would be
+// changed, next to it. Returns path of backup, empty if nothing was copied.
+func (tf *TemplateFile) backupUnmanaged(dir, name string) (string, error) {
+	state := tf.TemplateContext.state
+	if state == nil || state.managed(dir, name) {
+		return "", nil
+	}
+	info, err := os.Lstat(tf.OutputPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("'%v' exists and is not a regular file", tf.OutputPath)
+	}
+	output, err := tf.FinalOutput()
+	if err != nil || output == tf.Current {
+		return "", err
+	}
+
+	backup := backupName(tf.OutputPath, time.Now())
+	f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write([]byte(tf.Current))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return backup, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestHomeModeRefusesSymlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace func(t *testing.T, home, victim string)
+		want    string
+	}{
+		{
+			name: "managed file replaced by symlink",
+			replace: func(t *testing.T, home, victim string) {
+				os.Remove(filepath.Join(home, ".bashrc"))
+				if err := os.Symlink(victim, filepath.Join(home, ".bashrc")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "is a symlink",
+		},
+		{
+			name: "dir replaced by symlink",
+			replace: func(t *testing.T, home, victim string) {
+				os.RemoveAll(filepath.Join(home, ".config"))
+				if err := os.Symlink(filepath.Dir(victim), filepath.Join(home, ".config")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "is a symlink",
+		},
+		{
+			name: "managed file replaced by hard link",
+			replace: func(t *testing.T, home, victim string) {
+				os.Remove(filepath.Join(home, ".config/app.conf"))
+				if err := os.Link(victim, filepath.Join(home, ".config/app.conf")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "several links",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in, home, state := filepath.Join(dir, "in"), filepath.Join(dir, "home"), filepath.Join(dir, "state.json")
+			victim := filepath.Join(dir, "victim", "app.conf")
+			writeFiles(t, dir, map[string]string{
+				"in/dot_bashrc":          "v{{ .Env \"V\" }}",
+				"in/dot_config/app.conf": "v{{ .Env \"V\" }}",
+				"victim/app.conf":        "secret",
+			})
+			args := []string{"-id", in, "-od", home, "-home-mode", "-sf", state}
+			if os.Getuid() == 0 {
+				args = append(args, "-owner", "1234:1234")
+			}
+			run := func() error {
+				flags, err := NewFlags(args)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return Run(flags)
+			}
+
+			t.Setenv("V", "1")
+			err := run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.replace(t, home, victim)
+			t.Setenv("V", "2")
+			err = run()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want error %q", err, tt.want)
+			}
+
+			b, err := os.ReadFile(victim)
+			if err != nil || string(b) != "secret" {
+				t.Errorf("victim is changed: %q, %v", b, err)
+			}
+			info, err := os.Stat(victim)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uid := info.Sys().(*syscall.Stat_t).Uid; os.Getuid() == 0 && uid != 0 {
+				t.Errorf("victim is chowned to %v", uid)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Formatting functions
+//
+// Functions for human facing and fixed width outputs. Numbers may be passed
+// as numbers or as strings returned by TemplateContext accessors, widths are
+// measured in terminal cells, so wide and combining characters line up.
+// Widths are limited by output limit of safe mode.
+var humanizeFuncs = map[string]interface{}{
+	"humanBytes":    humanBytes,
+	"humanDuration": humanDuration,
+	"pluralize":     pluralize,
+	"ordinal":       ordinal,
+	"padLeft":       padLeft,
+	"padRight":      padRight,
+	"center":        center,
+	"truncate":      truncate,
+	"wordWrap":      wordWrap,
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	case time.Duration:
+		return float64(n), nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(rv.Len()), nil
+	}
+	return 0, fmt.Errorf("Expected number, got %T", v)
+}
+
+func toInt(v interface{}) (int, error) {
+	f, err := toFloat(v)
+	return int(f), err
+}
+
+// toWidth returns width of padded or wrapped text, capped by output limit of
+// safe mode, as padding is built before anything is written
+func toWidth(v interface{}) (int, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return 0, err
+	}
+	if f > safeMaxOutput {
+		return 0, fmt.Errorf("Width %v exceeds limit %v", v, safeMaxOutput)
+	}
+	return int(f), nil
+}
+
+func humanBytes(v interface{}) (string, error) {
+	n, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	i := 0
+	for math.Abs(n) >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %v", n, units[i]), nil
+	}
+	return fmt.Sprintf("%.1f %v", n, units[i]), nil
+}
+
+// humanDuration takes duration, duration string like "90m" or seconds and
+// returns two largest units, e.g. "1d 2h"
+func humanDuration(v interface{}) (string, error) {
+	var d time.Duration
+	switch t := v.(type) {
+	case time.Duration:
+		d = t
+	case string:
+		parsed, err := time.ParseDuration(strings.TrimSpace(t))
+		if err != nil {
+			seconds, ferr := toFloat(t)
+			if ferr != nil {
+				return "", err
+			}
+			parsed = time.Duration(seconds * float64(time.Second))
+		}
+		d = parsed
+	default:
+		seconds, err := toFloat(v)
+		if err != nil {
+			return "", err
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	if d < time.Second {
+		return sign + d.String(), nil
+	}
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	parts := []string{}
+	for _, unit := range units {
+		if d >= unit.d && len(parts) < 2 {
+			parts = append(parts, fmt.Sprintf("%d%v", d/unit.d, unit.name))
+			d %= unit.d
+		} else if len(parts) > 0 {
+			break
+		}
+	}
+	return sign + strings.Join(parts, " "), nil
+}
+
+// pluralize returns singular for count 1 and plural otherwise, plural
+// defaults to singular with "s"
+func pluralize(count interface{}, singular string, plural ...string) (string, error) {
+	n, err := toFloat(count)
+	if err != nil {
+		return "", err
+	}
+	if n == 1 {
+		return singular, nil
+	}
+	if len(plural) > 0 {
+		return plural[0], nil
+	}
+	return singular + "s", nil
+}
+
+func ordinal(v interface{}) (string, error) {
+	n, err := toInt(v)
+	if err != nil {
+		return "", err
+	}
+	suffix := "th"
+	switch abs := int(math.Abs(float64(n))); {
+	case abs%100 >= 11 && abs%100 <= 13:
+	case abs%10 == 1:
+		suffix = "st"
+	case abs%10 == 2:
+		suffix = "nd"
+	case abs%10 == 3:
+		suffix = "rd"
+	}
+	return strconv.Itoa(n) + suffix, nil
+}
+
+// Display width
+
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F}, {0x231A, 0x231B}, {0x2329, 0x232A}, {0x23E9, 0x23EC},
+	{0x2E80, 0x303E}, {0x3041, 0x33FF}, {0x3400, 0x4DBF}, {0x4E00, 0x9FFF},
+	{0xA000, 0xA4CF}, {0xA960, 0xA97F}, {0xAC00, 0xD7A3}, {0xF900, 0xFAFF},
+	{0xFE10, 0xFE19}, {0xFE30, 0xFE6F}, {0xFF00, 0xFF60}, {0xFFE0, 0xFFE6},
+	{0x1F300, 0x1F64F}, {0x1F680, 0x1F6FF}, {0x1F900, 0x1F9FF}, {0x1FA70, 0x1FAFF},
+	{0x20000, 0x2FFFD}, {0x30000, 0x3FFFD},
+}
+
+func runeWidth(r rune) int {
+	switch {
+	case r == 0 || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) || unicode.Is(unicode.Cf, r):
+		return 0
+	case !unicode.IsPrint(r):
+		return 0
+	}
+	for _, wide := range wideRanges {
+		if r >= wide[0] && r <= wide[1] {
+			return 2
+		}
+	}
+	return 1
+}
+
+func stringWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+func padLeft(width interface{}, s string) (string, error) {
+	w, err := toWidth(width)
+	if err != nil {
+		return "", err
+	}
+	return strings.Repeat(" ", max(w-stringWidth(s), 0)) + s, nil
+}
+
+func padRight(width interface{}, s string) (string, error) {
+	w, err := toWidth(width)
+	if err != nil {
+		return "", err
+	}
+	return s + strings.Repeat(" ", max(w-stringWidth(s), 0)), nil
+}
+
+func center(width interface{}, s string) (string, error) {
+	w, err := toWidth(width)
+	if err != nil {
+		return "", err
+	}
+	pad := max(w-stringWidth(s), 0)
+	return strings.Repeat(" ", pad/2) + s + strings.Repeat(" ", pad-pad/2), nil
+}
+
+// truncate cuts s to width, marking cut with "…"
+func truncate(width interface{}, s string) (string, error) {
+	w, err := toWidth(width)
+	if err != nil {
+		return "", err
+	}
+	if stringWidth(s) <= w {
+		return s, nil
+	}
+	if w <= 0 {
+		return "", nil
+	}
+	buf := new(strings.Builder)
+	used := 0
+	for _, r := range s {
+		rw := runeWidth(r)
+		if used+rw > w-1 {
+			break
+		}
+		buf.WriteRune(r)
+		used += rw
+	}
+	return buf.String() + "…", nil
+}
+
+// wordWrap wraps words of s into lines not wider than width, longer words
+// are kept on own line
+func wordWrap(width interface{}, s string) (string, error) {
+	w, err := toWidth(width)
+	if err != nil {
+		return "", err
+	}
+	paragraphs := strings.Split(s, "\n")
+	for i, paragraph := range paragraphs {
+		lines := []string{}
+		line, lineWidth := "", 0
+		for _, word := range strings.Fields(paragraph) {
+			wordWidth := stringWidth(word)
+			if line != "" && lineWidth+1+wordWidth > w {
+				lines = append(lines, line)
+				line, lineWidth = "", 0
+			}
+			if line != "" {
+				line += " "
+				lineWidth++
+			}
+			line += word
+			lineWidth += wordWidth
+		}
+		paragraphs[i] = strings.Join(append(lines, line), "\n")
+	}
+	return strings.Join(paragraphs, "\n"), nil
+}
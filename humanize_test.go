@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStringWidth(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"e\u0301", 1},              // e with combining acute
+		{"a\u200db", 2},             // zero width joiner
+		{"日本語", 6},                  // CJK
+		{"한글", 4},                   // Hangul syllables
+		{"ｆｕｌｌ", 8},                 // fullwidth forms
+		{"\U0001F642", 2},           // emoticon
+		{"\U0001F680", 2},           // transport symbol
+		{"\u2764\ufe0f", 1},         // variation selector adds nothing
+		{"\U0001F44D\U0001F3FD", 4}, // skin tone modifier is wide on its own
+		{"tab\there", 7},            // control characters take no cells
+	}
+	for _, tt := range tests {
+		if got := stringWidth(tt.s); got != tt.want {
+			t.Errorf("stringWidth(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	tests := []struct {
+		f     func(interface{}, string) (string, error)
+		name  string
+		width interface{}
+		s     string
+		want  string
+	}{
+		{padLeft, "padLeft", 5, "ab", "   ab"},
+		{padLeft, "padLeft", "5", "日本", " 日本"},
+		{padLeft, "padLeft", 1, "abc", "abc"},
+		{padLeft, "padLeft", -3, "a", "a"},
+		{padRight, "padRight", 4, "\u00e9", "\u00e9   "},
+		{padRight, "padRight", 4, "e\u0301", "e\u0301   "},
+		{center, "center", 6, "ab", "  ab  "},
+		{center, "center", 5, "ab", " ab  "},
+		{center, "center", 4, "日", " 日 "},
+	}
+	for _, tt := range tests {
+		got, err := tt.f(tt.width, tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("%v(%v, %q) = %q, %v, want %q", tt.name, tt.width, tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestWidthLimit(t *testing.T) {
+	for name, f := range map[string]func(interface{}, string) (string, error){
+		"padLeft":  padLeft,
+		"padRight": padRight,
+		"center":   center,
+		"truncate": truncate,
+		"wordWrap": wordWrap,
+	} {
+		for _, width := range []interface{}{"100000000000", 1e30, safeMaxOutput + 1} {
+			_, err := f(width, "x")
+			if err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+				t.Errorf("%v(%v): got %v, want limit error", name, width, err)
+			}
+		}
+		if _, err := f(safeMaxOutput, "x"); err != nil {
+			t.Errorf("%v(%v): %v", name, safeMaxOutput, err)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		width int
+		s     string
+		want  string
+	}{
+		{5, "hello", "hello"},
+		{4, "hello", "hel…"},
+		{1, "hello", "…"},
+		{0, "hello", ""},
+		{-1, "hello", ""},
+		{0, "", ""},
+		{4, "日本語", "日…"},
+		{5, "日本語", "日本…"},
+		{3, "e\u0301e\u0301e\u0301e\u0301", "e\u0301e\u0301…"},
+	}
+	for _, tt := range tests {
+		got, err := truncate(tt.width, tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("truncate(%v, %q) = %q, %v, want %q", tt.width, tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestWordWrap(t *testing.T) {
+	tests := []struct {
+		width int
+		s     string
+		want  string
+	}{
+		{10, "one two three four", "one two\nthree four"},
+		{7, "one two", "one two"},
+		{6, "one two", "one\ntwo"},
+		{3, "a verylongword b", "a\nverylongword\nb"},
+		{0, "a b", "a\nb"},
+		{10, "  spaced   out  ", "spaced out"},
+		{10, "first para\n\nsecond", "first para\n\nsecond"},
+		{4, "日本 語", "日本\n語"},
+		{10, "", ""},
+	}
+	for _, tt := range tests {
+		got, err := wordWrap(tt.width, tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("wordWrap(%v, %q) = %q, %v, want %q", tt.width, tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestHumanize(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func() (string, error)
+		want string
+	}{
+		{"bytes", func() (string, error) { return humanBytes(512) }, "512 B"},
+		{"bytes string", func() (string, error) { return humanBytes("1536") }, "1.5 KiB"},
+		{"bytes negative", func() (string, error) { return humanBytes(-1 << 30) }, "-1.0 GiB"},
+		{"duration", func() (string, error) { return humanDuration(93784 * time.Second) }, "1d 2h"},
+		{"duration string", func() (string, error) { return humanDuration("90m") }, "1h 30m"},
+		{"duration seconds", func() (string, error) { return humanDuration("61") }, "1m 1s"},
+		{"duration gap", func() (string, error) { return humanDuration(time.Hour + time.Second) }, "1h"},
+		{"duration small", func() (string, error) { return humanDuration(-1500 * time.Millisecond) }, "-1s"},
+		{"duration below second", func() (string, error) { return humanDuration(time.Millisecond) }, "1ms"},
+		{"pluralize one", func() (string, error) { return pluralize(1, "file") }, "file"},
+		{"pluralize many", func() (string, error) { return pluralize("2", "file") }, "files"},
+		{"pluralize irregular", func() (string, error) { return pluralize(0, "child", "children") }, "children"},
+		{"pluralize slice", func() (string, error) { return pluralize([]string{"a"}, "item") }, "item"},
+		{"ordinal", func() (string, error) { return ordinal(1) }, "1st"},
+		{"ordinal 12", func() (string, error) { return ordinal(12) }, "12th"},
+		{"ordinal 22", func() (string, error) { return ordinal("22") }, "22nd"},
+		{"ordinal 113", func() (string, error) { return ordinal(113) }, "113th"},
+		{"ordinal negative", func() (string, error) { return ordinal(-3) }, "-3rd"},
+	}
+	for _, tt := range tests {
+		got, err := tt.f()
+		if err != nil || got != tt.want {
+			t.Errorf("%v: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := humanBytes("lots"); err == nil {
+		t.Error("humanBytes of text: expected error")
+	}
+}
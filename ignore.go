@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Globs
+//
+// Globs match slash separated paths. "*" and "?" do not match "/", "**"
+// matches any number of dirs. Pattern without "/" matches base name at any
+// depth, pattern ending with "/" matches everything inside of dir.
+func globRegexp(pattern string) *regexp.Regexp {
+	dir := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	anywhere := !strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	expr := new(strings.Builder)
+	expr.WriteString("^")
+	if anywhere {
+		expr.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if dir {
+		expr.WriteString("/.*")
+	} else {
+		expr.WriteString("(/.*)?")
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+func matchGlob(pattern, name string) bool {
+	return globRegexp(pattern).MatchString(filepath.ToSlash(name))
+}
+
+// Ignore file
+//
+// Input dir may have .envtemplaterignore with globs of files, which are not
+// templates. Empty lines and lines starting with "#" are skipped.
+const ignoreFileName = ".envtemplaterignore"
+
+func loadIgnore(dir string) ([]string, error) {
+	patterns := []string{ignoreFileName}
+
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return patterns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+func ignored(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
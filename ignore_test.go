@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.swp", "a.swp", true},
+		{"*.swp", "dir/sub/a.swp", true},
+		{"*.swp", "a.swp.conf", false},
+		{"a?.conf", "ab.conf", true},
+		{"a?.conf", "a/.conf", false},
+		{"nginx/*.conf", "nginx/a.conf", true},
+		{"nginx/*.conf", "nginx/sites/a.conf", false},
+		{"nginx/*.conf", "other/nginx/a.conf", false},
+		{"/nginx", "nginx/a.conf", true},
+		{"/nginx", "other/nginx", false},
+		{"nginx/**/*.conf", "nginx/a.conf", true},
+		{"nginx/**/*.conf", "nginx/sites/enabled/a.conf", true},
+		{"nginx/**", "nginx/sites/a.conf", true},
+		{"**/cache", "a/b/cache/x", true},
+		{"build/", "build/out.txt", true},
+		{"build/", "build", false},
+		{"build", "build", true},
+		{"build", "src/build/out.txt", true},
+		{"a.conf", "a_conf", false},
+		{"a+b", "a+b", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
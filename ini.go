@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// INI and properties edits
+//
+// In ini and properties output modes the rendered template is not the file
+// itself, but a list of settings which are applied to the file existing at
+// OutputPath. Only listed keys are changed, everything else is kept as is.
+
+type iniSetting struct {
+	Section string
+	Key     string
+	Value   string
+}
+
+type iniKey struct {
+	section string
+	key     string
+}
+
+type iniDialect struct {
+	sections   bool
+	comments   string
+	separators string
+	format     string
+}
+
+var (
+	iniFormat        = iniDialect{sections: true, comments: ";#", separators: "=", format: "%s = %s"}
+	propertiesFormat = iniDialect{sections: false, comments: "#!", separators: "=:", format: "%s=%s"}
+)
+
+func iniDialectFor(mode string) iniDialect {
+	if mode == "properties" {
+		return propertiesFormat
+	}
+	return iniFormat
+}
+
+func (d iniDialect) isComment(line string) bool {
+	return line == "" || strings.ContainsRune(d.comments, rune(line[0]))
+}
+func (d iniDialect) section(line string) (string, bool) {
+	if !d.sections || !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return "", false
+	}
+	return strings.TrimSpace(line[1 : len(line)-1]), true
+}
+
+// split returns key of raw line and offset where its value starts
+func (d iniDialect) split(raw string) (string, int, bool) {
+	i := strings.IndexAny(raw, d.separators)
+	if i == -1 {
+		return "", 0, false
+	}
+	key := strings.TrimSpace(raw[:i])
+	if key == "" {
+		return "", 0, false
+	}
+	start := i + 1
+	for start < len(raw) && (raw[start] == ' ' || raw[start] == '\t') {
+		start++
+	}
+	return key, start, true
+}
+
+func (d iniDialect) parseSettings(s string) ([]iniSetting, error) {
+	settings := []iniSetting{}
+	section := ""
+	for i, raw := range strings.Split(s, "\n") {
+		line := strings.TrimSpace(raw)
+		if d.isComment(line) {
+			continue
+		}
+		if name, ok := d.section(line); ok {
+			section = name
+			continue
+		}
+		key, start, ok := d.split(line)
+		if !ok {
+			return nil, fmt.Errorf("Line %v: expected key%svalue, got '%v'", i+1, d.separators[:1], line)
+		}
+		settings = append(settings, iniSetting{
+			Section: section,
+			Key:     key,
+			Value:   line[start:],
+		})
+	}
+	return settings, nil
+}
+
+func (d iniDialect) apply(current string, settings []iniSetting) string {
+	lines := []string{}
+	if current != "" {
+		lines = strings.Split(strings.TrimSuffix(current, "\n"), "\n")
+	}
+
+	values := map[iniKey]string{}
+	for _, setting := range settings {
+		values[iniKey{setting.Section, setting.Key}] = setting.Value
+	}
+
+	// remember where each section ends and last line of each key, repeated
+	// keys like php.ini extension are kept, only the last one is changed
+	sectionEnd := map[string]int{"": 0}
+	lastLine := map[iniKey]int{}
+	section := ""
+	for i, raw := range lines {
+		line := strings.TrimSpace(raw)
+		if name, ok := d.section(line); ok {
+			section = name
+			sectionEnd[section] = i + 1
+			continue
+		}
+		if d.isComment(line) {
+			continue
+		}
+		sectionEnd[section] = i + 1
+		if key, _, ok := d.split(raw); ok {
+			lastLine[iniKey{section, key}] = i
+		}
+	}
+
+	// change existing keys
+	applied := map[iniKey]bool{}
+	for k, i := range lastLine {
+		v, ok := values[k]
+		if !ok {
+			continue
+		}
+		_, start, _ := d.split(lines[i])
+		lines[i] = lines[i][:start] + v
+		applied[k] = true
+	}
+
+	// group missing keys by section, keeping order of settings
+	missing := map[string][]string{}
+	newSections := []string{}
+	for _, setting := range settings {
+		k := iniKey{setting.Section, setting.Key}
+		if applied[k] {
+			continue
+		}
+		applied[k] = true
+		if _, ok := sectionEnd[setting.Section]; !ok && missing[setting.Section] == nil {
+			newSections = append(newSections, setting.Section)
+		}
+		missing[setting.Section] = append(missing[setting.Section], fmt.Sprintf(d.format, setting.Key, values[k]))
+	}
+
+	// insert into existing sections from the bottom, so indexes stay valid
+	existing := []string{}
+	for name := range missing {
+		if _, ok := sectionEnd[name]; ok {
+			existing = append(existing, name)
+		}
+	}
+	for len(existing) > 0 {
+		last := 0
+		for i, name := range existing {
+			if sectionEnd[name] > sectionEnd[existing[last]] {
+				last = i
+			}
+		}
+		name := existing[last]
+		existing = append(existing[:last], existing[last+1:]...)
+
+		at := sectionEnd[name]
+		lines = append(lines[:at], append(missing[name], lines[at:]...)...)
+	}
+
+	// append sections which does not exist yet
+	for _, name := range newSections {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+name+"]")
+		lines = append(lines, missing[name]...)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
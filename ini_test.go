@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestIniApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  iniDialect
+		current  string
+		settings string
+		want     string
+	}{
+		{
+			name:     "change existing key keeping spacing",
+			dialect:  iniFormat,
+			current:  "[db]\nhost   =  old\nport = 1\n",
+			settings: "[db]\nhost = new\n",
+			want:     "[db]\nhost   =  new\nport = 1\n",
+		},
+		{
+			name:     "insert missing key at end of its section",
+			dialect:  iniFormat,
+			current:  "[a]\nx = 1\n\n[b]\ny = 2\n",
+			settings: "[a]\nz = 3\n",
+			want:     "[a]\nx = 1\nz = 3\n\n[b]\ny = 2\n",
+		},
+		{
+			name:     "append missing section",
+			dialect:  iniFormat,
+			current:  "[a]\nx = 1\n",
+			settings: "[c]\nw = 4\n",
+			want:     "[a]\nx = 1\n\n[c]\nw = 4\n",
+		},
+		{
+			name:     "same key in other section is kept",
+			dialect:  iniFormat,
+			current:  "[a]\nx = 1\n[b]\nx = 2\n",
+			settings: "[b]\nx = 3\n",
+			want:     "[a]\nx = 1\n[b]\nx = 3\n",
+		},
+		{
+			name:     "only last of repeated keys is changed",
+			dialect:  iniFormat,
+			current:  "extension=a\nextension=b\nmemory_limit=1M\n",
+			settings: "extension = c\n",
+			want:     "extension=a\nextension=c\nmemory_limit=1M\n",
+		},
+		{
+			name:     "comments are kept",
+			dialect:  iniFormat,
+			current:  "; x = 0\nx = 1\n# end\n",
+			settings: "x = 2\n",
+			want:     "; x = 0\nx = 2\n# end\n",
+		},
+		{
+			name:     "empty file",
+			dialect:  iniFormat,
+			current:  "",
+			settings: "x = 1\n",
+			want:     "x = 1\n",
+		},
+		{
+			name:     "properties with colon separator",
+			dialect:  propertiesFormat,
+			current:  "! comment\nserver.port: 80\n",
+			settings: "server.port=8080\nserver.host=localhost\n",
+			want:     "! comment\nserver.port: 8080\nserver.host=localhost\n",
+		},
+		{
+			name:     "properties have no sections",
+			dialect:  propertiesFormat,
+			current:  "[a]=1\n",
+			settings: "[a]=2\n",
+			want:     "[a]=2\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := tt.dialect.parseSettings(tt.settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tt.dialect.apply(tt.current, settings)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIniParseSettingsError(t *testing.T) {
+	_, err := iniFormat.parseSettings("[a]\nnot a setting\n")
+	if err == nil {
+		t.Fatal("expected error for line without separator")
+	}
+}
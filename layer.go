@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OCI layer output
+//
+// With -oci-layer output dir is path of layer tarball, which can be appended
+// to an image. Layer is gzipped when path ends with .gz or .tgz. Pruned files
+// are written as whiteouts, so they disappear from the image.
+
+// parseOwner parses "uid:gid"
+func parseOwner(owner string) (int, int, error) {
+	u, g, ok := strings.Cut(owner, ":")
+	uid, err := strconv.Atoi(u)
+	if err == nil && ok {
+		var gid int
+		gid, err = strconv.Atoi(g)
+		if err == nil {
+			return uid, gid, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Bad owner '%v', expected uid:gid", owner)
+}
+
+func validOwner(owner string) bool {
+	_, _, err := parseOwner(owner)
+	return err == nil
+}
+
+type layerEntry struct {
+	name     string
+	mode     int64
+	uid, gid int
+	dir      bool
+	content  []byte
+}
+
+func writeOCILayer(flags Flags, templateFiles []*TemplateFile, manifest []byte, pruned []string) error {
+	uid, gid := 0, 0
+	if flags.Owner != "" {
+		var err error
+		uid, gid, err = parseOwner(flags.Owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries := []layerEntry{}
+	if flags.ID != "" {
+		dirs, err := recursiveGetDirs(flags.ID)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			info, err := os.Stat(filepath.Join(flags.ID, dir))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, layerEntry{name: filepath.ToSlash(dir), mode: int64(info.Mode().Perm()), uid: uid, gid: gid, dir: true})
+		}
+	}
+	// mode and owner of files come from settings, like in SaveOutput
+	for _, templateFile := range templateFiles {
+		output, err := templateFile.FinalOutput()
+		if err != nil {
+			return err
+		}
+		entry := layerEntry{name: outputName(flags, templateFile.OutputPath), mode: 0664, uid: uid, gid: gid, content: []byte(output)}
+		if templateFile.Settings.Mode != 0 {
+			entry.mode = int64(templateFile.Settings.Mode)
+		}
+		if templateFile.Settings.Owner != "" {
+			entry.uid, entry.gid, err = parseOwner(templateFile.Settings.Owner)
+			if err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if manifest != nil {
+		entries = append(entries, layerEntry{name: assetManifestName, mode: 0664, uid: uid, gid: gid, content: manifest})
+	}
+	for _, name := range pruned {
+		whiteout := path.Join(path.Dir(name), ".wh."+path.Base(name))
+		entries = append(entries, layerEntry{name: whiteout, mode: 0644, uid: uid, gid: gid, content: []byte{}})
+	}
+	// parents go before children
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:    entry.name,
+			Mode:    entry.mode,
+			Uid:     entry.uid,
+			Gid:     entry.gid,
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		if entry.dir {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(entry.content))
+		}
+		err := tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write(entry.content)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+
+	layer := buf.Bytes()
+	diffID := sha256.Sum256(layer)
+	if strings.HasSuffix(flags.OD, ".gz") || strings.HasSuffix(flags.OD, ".tgz") {
+		gzBuf := new(bytes.Buffer)
+		gz := gzip.NewWriter(gzBuf)
+		_, err = gz.Write(layer)
+		if err == nil {
+			err = gz.Close()
+		}
+		if err != nil {
+			return err
+		}
+		layer = gzBuf.Bytes()
+	}
+	digest := sha256.Sum256(layer)
+
+	err = writeFileAtomic(flags.OD, layer, 0664)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("diff-id: sha256:%v\n", hex.EncodeToString(diffID[:]))
+	fmt.Printf("digest: sha256:%v\n", hex.EncodeToString(digest[:]))
+	return nil
+}
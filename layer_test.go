@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOCILayerModeAndOwner(t *testing.T) {
+	dir := t.TempDir()
+	in, layer := filepath.Join(dir, "in"), filepath.Join(dir, "layer.tar")
+	writeFiles(t, dir, map[string]string{
+		"in/a.conf":                     `a`,
+		"in/secret/" + manifestFileName: "mode = \"0600\"\nowner = \"10:20\"\n",
+		"in/secret/b.conf":              `b`,
+	})
+
+	flags, err := NewFlags([]string{"-id", in, "-od", layer, "-oci-layer", "-owner", "1:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Run(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got := map[string]tar.Header{}
+	r := tar.NewReader(f)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[h.Name] = *h
+	}
+
+	tests := []struct {
+		name     string
+		mode     int64
+		uid, gid int
+	}{
+		{"a.conf", 0664, 1, 2},
+		{"secret/b.conf", 0600, 10, 20},
+	}
+	for _, tt := range tests {
+		h, ok := got[tt.name]
+		if !ok {
+			t.Errorf("%v: missing in layer", tt.name)
+			continue
+		}
+		if h.Mode != tt.mode || h.Uid != tt.uid || h.Gid != tt.gid {
+			t.Errorf("%v: got %o %v:%v, want %o %v:%v", tt.name, h.Mode, h.Uid, h.Gid, tt.mode, tt.uid, tt.gid)
+		}
+	}
+}
@@ -6,18 +6,84 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"text/template"
+	"time"
 )
 
 // Operations with FS
-func safeMkdir(path string) error {
-	err := os.Mkdir(path, 0775)
+
+// safeMkdir creates dir if it does not exist, returns true when dir was created
+func safeMkdir(path string, perm os.FileMode) (bool, error) {
+	err := os.Mkdir(path, perm)
 	if os.IsExist(err) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		if !info.IsDir() {
+			return false, fmt.Errorf("'%v' exists and is not a dir", path)
+		}
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// writeFileAtomic replaces file by renaming temp file over it. Existing file
+// keeps its mode and owner, symlink is written through to its target.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	uid, gid := -1, -1
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(stat.Uid), int(stat.Gid)
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil && uid != -1 {
+		err = chownLike(f, uid, gid)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// chownLike changes owner of f when it differs, so non-root user may replace
+// own files
+func chownLike(f *os.File, uid, gid int) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) == uid && int(stat.Gid) == gid {
 		return nil
 	}
-	return err
+	return f.Chown(uid, gid)
 }
 func recursiveGetDirs(path string) ([]string, error) {
 	dirs := []string{}
@@ -71,42 +137,165 @@ func recursiveGetFiles(path string) ([]string, error) {
 
 	return files, nil
 }
-func recursiveCopyDir(src, rmt string) error {
-	err := safeMkdir(rmt)
+
+type copyDirOptions struct {
+	// Owner is uid:gid of dirs, empty to keep default
+	Owner string
+	// Only holds dirs to create, nil to create all
+	Only map[string]bool
+	// Rename maps slash separated name of src dir to name in rmt
+	Rename func(string) string
+}
+
+// createdDir is dir created by recursiveCopyDir, which gets mode of its src
+// dir by applyDirModes
+type createdDir struct {
+	path string
+	perm os.FileMode
+}
+
+// recursiveCopyDir mirrors dir struct of src in rmt. Missing parents of rmt
+// are created, existing dirs keep their mode and owner. Created dirs get
+// owner at once, but stay writable by owner until applyDirModes is called,
+// so read-only src dirs don't prevent writing outputs.
+func recursiveCopyDir(src, rmt string, opts copyDirOptions) ([]createdDir, error) {
+	uid, gid := -1, -1
+	if opts.Owner != "" {
+		var err error
+		uid, gid, err = parseOwner(opts.Owner)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := os.Stat(src)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(filepath.Clean(rmt)), 0775)
+	if err != nil {
+		return nil, err
+	}
+	created := []createdDir{}
+	err = mirrorDir(&created, rmt, info.Mode().Perm(), uid, gid)
+	if err != nil {
+		return created, err
 	}
 
 	dirs, err := recursiveGetDirs(src)
 	if err != nil {
-		return err
+		return created, err
 	}
 
 	for _, dir := range dirs {
-		err = safeMkdir(filepath.Join(rmt, dir))
+		name := filepath.ToSlash(dir)
+		if opts.Rename != nil {
+			name = opts.Rename(name)
+		}
+		if opts.Only != nil && !opts.Only[name] {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(src, dir))
 		if err != nil {
-			return err
+			return created, err
+		}
+		err = mirrorDir(&created, filepath.Join(rmt, filepath.FromSlash(name)), info.Mode().Perm(), uid, gid)
+		if err != nil {
+			return created, err
 		}
 	}
 
+	return created, nil
+}
+
+// mirrorDir creates missing dir with owner if uid is not -1 and adds it to
+// created
+func mirrorDir(created *[]createdDir, path string, perm os.FileMode, uid, gid int) error {
+	ok, err := safeMkdir(path, perm|0700)
+	if err != nil || !ok {
+		return err
+	}
+	*created = append(*created, createdDir{path, perm})
+	if uid == -1 {
+		return nil
+	}
+	return changeNoFollow(path, func(f *os.File) error { return f.Chown(uid, gid) })
+}
+
+// applyDirModes sets modes of created dirs ignoring umask, deepest first
+func applyDirModes(dirs []createdDir) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		perm := dirs[i].perm
+		err := changeNoFollow(dirs[i].path, func(f *os.File) error { return f.Chmod(perm) })
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// changeNoFollow changes mode or owner of path through opened file, so
+// symlink put in its place by owner of parent dir is not followed
+func changeNoFollow(path string, change func(*os.File) error) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return change(f)
+}
+
 // Template context
 func NewTemplateContext() *TemplateContext {
-	envs := make(map[string]string)
+	redactor, _ := NewRedactor("full", "", "")
+	tx := &TemplateContext{
+		envs:          map[string]string{},
+		sources:       map[string][]envSource{},
+		redactor:      redactor,
+		counterOwners: map[string]string{},
+		assets:        map[string]string{},
+		origins:       map[string]string{},
+		dns:           newDNSResolver("", defaultDNSTimeout),
+	}
 	for _, str := range os.Environ() {
 		substrs := strings.SplitN(str, "=", 2)
-		envs[substrs[0]] = strings.Trim(substrs[1], "\n")
-	}
-
-	return &TemplateContext{
-		envs: envs,
+		tx.setEnv(environmentLayer, substrs[0], strings.Trim(substrs[1], "\n"))
 	}
+	return tx
 }
 
 type TemplateContext struct {
 	envs map[string]string
+	// sources holds values of variables by layer they come from
+	sources map[string][]envSource
+
+	safe     bool
+	allowed  map[string]bool
+	redactor *Redactor
+
+	state         *State
+	counterOwners map[string]string
+	assets        map[string]string
+	s3            *s3Client
+	fetcher       *fetcher
+	dns           *dnsResolver
+	user          *HomeUser
+	// origins holds name of variable by value read with Env
+	origins map[string]string
+}
+
+// clone returns context with own copy of variables, sharing everything else
+func (tx *TemplateContext) clone() *TemplateContext {
+	c := *tx
+	c.envs = make(map[string]string, len(tx.envs))
+	for k, v := range tx.envs {
+		c.envs[k] = v
+	}
+	c.sources = make(map[string][]envSource, len(tx.sources))
+	for k, v := range tx.sources {
+		c.sources[k] = append([]envSource{}, v...)
+	}
+	return &c
 }
 
 func (tx *TemplateContext) loadEnvFile(path string) error {
@@ -123,16 +312,20 @@ func (tx *TemplateContext) loadEnvFile(path string) error {
 		}
 		kw := strings.SplitN(line, "=", 2)
 		// add to envs
-		tx.envs[kw[0]] = kw[1]
+		tx.setEnv(path, kw[0], kw[1])
 	}
 	return nil
 }
 
 func (tx *TemplateContext) Env(name string) (string, error) {
+	if tx.safe && !tx.allowed[name] {
+		return "", fmt.Errorf("Error, variable '%v' is not allowed in safe mode", name)
+	}
 	v, ok := tx.envs[name]
 	if !ok {
 		return "", fmt.Errorf("Error, missing variable '%v'", name)
 	}
+	tx.origins[v] = name
 	return v, nil
 }
 func (tx *TemplateContext) List(name string, delimiter string) ([]string, error) {
@@ -154,18 +347,111 @@ func (tx *TemplateContext) Dict(name, itemDelimeter, kvDelimeter string) (map[st
 	}
 	return dict, nil
 }
+
+// Redacted returns value of variable redacted by configured strategy
+func (tx *TemplateContext) Redacted(name string) (string, error) {
+	env, err := tx.Env(name)
+	if err != nil {
+		return "", err
+	}
+	return tx.redactor.Redact(env), nil
+}
 func (tx *TemplateContext) Exist(name string) bool {
-	_, exist := tx.envs[name]
+	_, exist := tx.lookup(name)
 	return exist
 }
 func (tx *TemplateContext) NotExist(name string) bool {
-	_, exist := tx.envs[name]
+	_, exist := tx.lookup(name)
 	return !exist
 }
 
+// Template data
+//
+// Data passed to a template: shared TemplateContext plus values of the
+// file being rendered.
+type TemplateData struct {
+	*TemplateContext
+	// User is user whose home is rendered, nil outside of home mode
+	User *HomeUser
+	file *TemplateFile
+}
+
+// Current returns content existing at OutputPath, empty if there is no file
+func (td *TemplateData) Current() (string, error) {
+	if td.TemplateContext.safe {
+		return "", fmt.Errorf("Current content is not available in safe mode")
+	}
+	return td.file.Current, nil
+}
+
+// CurrentSection returns lines of current content between lines marked with
+// "BEGIN name" and "END name", empty if there is no such section
+func (td *TemplateData) CurrentSection(name string) (string, error) {
+	if td.TemplateContext.safe {
+		return "", fmt.Errorf("Current content is not available in safe mode")
+	}
+	begin := regexp.MustCompile(`\bBEGIN\s+` + regexp.QuoteMeta(name) + `(\s|$)`)
+	end := regexp.MustCompile(`\bEND\s+` + regexp.QuoteMeta(name) + `(\s|$)`)
+
+	lines := strings.SplitAfter(td.file.Current, "\n")
+	for i, line := range lines {
+		if !begin.MatchString(line) {
+			continue
+		}
+		for j := i + 1; j < len(lines); j++ {
+			if end.MatchString(lines[j]) {
+				return strings.Join(lines[i+1:j], ""), nil
+			}
+		}
+		break
+	}
+	return "", nil
+}
+
+// Front matter
+//
+// Template may start with a comment block holding "key: value" lines:
+//
+//	{{/*---
+//	hashName: true
+//	---*/}}
+//
+// The block renders to nothing, newline after it is moved inside the comment
+// so output does not start with empty line and line numbers stay the same.
+const (
+	frontMatterStart = "{{/*---\n"
+	frontMatterEnd   = "\n---*/}}"
+)
+
+func parseFrontMatter(input string) (map[string]string, string) {
+	values := map[string]string{}
+	if !strings.HasPrefix(input, frontMatterStart) {
+		return values, input
+	}
+	end := strings.Index(input, frontMatterEnd)
+	if end == -1 {
+		return values, input
+	}
+
+	for _, line := range strings.Split(input[len(frontMatterStart):end], "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	rest := input[end+len(frontMatterEnd):]
+	if strings.HasPrefix(rest, "\n") {
+		input = input[:end] + "\n" + frontMatterEnd + rest[1:]
+	}
+	return values, input
+}
+
 // Template file
-func NewTemplateFile(tx *TemplateContext, inputPath, outputPath string) *TemplateFile {
+func NewTemplateFile(tx *TemplateContext, name, inputPath, outputPath string) *TemplateFile {
 	return &TemplateFile{
+		Name:            filepath.ToSlash(name),
 		InputPath:       inputPath,
 		OutputPath:      outputPath,
 		TemplateContext: tx,
@@ -173,41 +459,197 @@ func NewTemplateFile(tx *TemplateContext, inputPath, outputPath string) *Templat
 }
 
 type TemplateFile struct {
-	InputPath       string
-	Input           string
-	OutputPath      string
-	Output          string
+	// Name is path relative to input dir, used to refer file from templates
+	Name        string
+	InputPath   string
+	Input       string
+	FrontMatter map[string]string
+	OutputPath  string
+	Output      string
+	OutputMode  string
+	Current     string
+	// Diagnostics holds reports of warn, deprecated and fail calls
+	Diagnostics []Diagnostic
+	// Skipped is set by SaveOutput when output already has the same content
+	Skipped bool
+	// Changed is set by SaveOutput when saved content differs from current
+	Changed         bool
+	Settings        *DirSettings
 	TemplateContext *TemplateContext
+
+	templater *template.Template
+	// counters used by template, value is true for dated counters
+	counters map[string]bool
+	tplDepth int
+	// canceled is set when execution in safe mode exceeds time limit
+	canceled atomic.Bool
 }
 
 func (tf *TemplateFile) LoadInput() error {
-	b, err := os.ReadFile(tf.InputPath)
+	var b []byte
+	var err error
+	if isHTTPURL(tf.InputPath) {
+		b, err = tf.TemplateContext.fetcher.Fetch(tf.InputPath)
+	} else {
+		b, err = os.ReadFile(tf.InputPath)
+	}
 	if err != nil {
 		return err
 	}
-	tf.Input = string(b)
+	tf.FrontMatter, tf.Input = parseFrontMatter(string(b))
 	return nil
 }
-func (tf *TemplateFile) Template() error {
-	buf := new(bytes.Buffer)
-	templater, err := template.New(tf.InputPath).Parse(tf.Input)
+func (tf *TemplateFile) LoadCurrent() error {
+	if isS3URL(tf.OutputPath) {
+		current, err := tf.TemplateContext.s3.Get(tf.OutputPath)
+		tf.Current = current
+		return err
+	}
+	b, err := os.ReadFile(tf.OutputPath)
+	if os.IsNotExist(err) {
+		tf.Current = ""
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tf.Current = string(b)
+	return nil
+}
+func (tf *TemplateFile) data() *TemplateData {
+	return &TemplateData{
+		TemplateContext: tf.TemplateContext,
+		User:            tf.TemplateContext.user,
+		file:            tf,
+	}
+}
+func (tf *TemplateFile) newTemplate(name string) *template.Template {
+	return template.New(name).Delims(tf.Settings.LeftDelim, tf.Settings.RightDelim).Funcs(tf.funcMap())
+}
+func (tf *TemplateFile) Parse() error {
+	if tf.Settings.Engine == "none" {
+		return nil
+	}
+	templater, err := tf.newTemplate(tf.InputPath).Parse(tf.Input)
 	if err != nil {
 		return err
 	}
-	err = templater.Execute(buf, tf.TemplateContext)
+	annotate(templater)
+	tf.templater = templater
+	return nil
+}
+func (tf *TemplateFile) Template() error {
+	if tf.Settings.Engine == "none" {
+		tf.Output = tf.Input
+		return nil
+	}
+	if tf.templater == nil {
+		err := tf.Parse()
+		if err != nil {
+			return err
+		}
+	}
+	tf.Diagnostics = nil
+	buf := new(bytes.Buffer)
+	err := tf.execute(tf.templater, buf)
 	if err != nil {
 		return err
 	}
 	tf.Output = buf.String()
+	tf.resolveCounters()
 	return nil
 }
+
+// FinalOutput returns content to save, applying edits in edit output modes
+func (tf *TemplateFile) FinalOutput() (string, error) {
+	switch tf.OutputMode {
+	case "ini", "properties":
+		return tf.applySettings(iniDialectFor(tf.OutputMode))
+	case "xml":
+		return tf.applyXMLEdits()
+	}
+	return tf.Output, nil
+}
 func (tf *TemplateFile) SaveOutput() error {
-	return os.WriteFile(tf.OutputPath, []byte(tf.Output), 0664)
+	output, err := tf.FinalOutput()
+	if err != nil {
+		return err
+	}
+	err = tf.validate(output)
+	if err != nil {
+		return err
+	}
+	tf.Changed = output != tf.Current
+
+	if isS3URL(tf.OutputPath) {
+		tf.Skipped, err = tf.TemplateContext.s3.Put(tf.OutputPath, []byte(output))
+		tf.Changed = !tf.Skipped
+		return err
+	}
+	if tf.TemplateContext.user != nil && (tf.OutputMode == "template" || tf.OutputMode == "") {
+		uid, gid := -1, -1
+		if tf.Settings.Owner != "" {
+			uid, gid, err = parseOwner(tf.Settings.Owner)
+			if err != nil {
+				return err
+			}
+		}
+		return writeHomeFile(tf.OutputPath, []byte(output), tf.Settings.Mode, uid, gid)
+	}
+	// edited files are replaced atomically, they are likely in use
+	if tf.OutputMode != "template" && tf.OutputMode != "" {
+		err = writeFileAtomic(tf.OutputPath, []byte(output), 0664)
+	} else {
+		err = os.WriteFile(tf.OutputPath, []byte(output), 0664)
+	}
+	if err != nil {
+		return err
+	}
+
+	if tf.Settings.Mode != 0 {
+		err = os.Chmod(tf.OutputPath, tf.Settings.Mode)
+		if err != nil {
+			return err
+		}
+	}
+	if tf.Settings.Owner != "" {
+		uid, gid, err := parseOwner(tf.Settings.Owner)
+		if err != nil {
+			return err
+		}
+		return os.Chown(tf.OutputPath, uid, gid)
+	}
+	return nil
+}
+
+// applySettings applies rendered settings to current content
+func (tf *TemplateFile) applySettings(dialect iniDialect) (string, error) {
+	settings, err := dialect.parseSettings(tf.Output)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", tf.InputPath, err)
+	}
+	return dialect.apply(tf.Current, settings), nil
+}
+
+// applyXMLEdits applies rendered edits to current xml document
+func (tf *TemplateFile) applyXMLEdits() (string, error) {
+	edits, err := parseXMLEdits(tf.Output)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", tf.InputPath, err)
+	}
+	if tf.Current == "" {
+		return "", fmt.Errorf("%v: missing xml document to edit", tf.OutputPath)
+	}
+	output, err := applyXMLEdits(tf.Current, edits)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", tf.OutputPath, err)
+	}
+	return output, nil
 }
 
 // Flags
 
-func NewFlags() (Flags, error) {
+func NewFlags(args []string) (Flags, error) {
 	flags := Flags{}
 
 	flagSet := flag.NewFlagSet("envtemplater", flag.ContinueOnError)
@@ -215,21 +657,81 @@ func NewFlags() (Flags, error) {
 	flagSet.StringVar(&flags.OF, "of", "", "Output file")
 	flagSet.StringVar(&flags.ID, "id", "", "Input dir")
 	flagSet.StringVar(&flags.OD, "od", "", "Output dir")
-	flagSet.StringVar(&flags.EF, "ef", "", "Environment file")
+	flagSet.StringVar(&flags.EF, "ef", "", "Comma separated environment files, later override earlier")
+	flagSet.StringVar(&flags.SF, "sf", "", "State file")
+	flagSet.BoolVar(&flags.Safe, "safe", false, "Safe mode for untrusted templates")
+	flagSet.StringVar(&flags.AllowEnv, "allow-env", "", "Comma separated variables readable in safe mode")
+	flagSet.StringVar(&flags.Recipient, "recipient", "", "Default X25519 public key for encrypted outputs")
+	flagSet.StringVar(&flags.S3Endpoint, "s3-endpoint", "", "Endpoint of S3 compatible storage for s3:// outputs")
+	flagSet.StringVar(&flags.CacheDir, "cache-dir", "", "Cache dir for templates fetched by url")
+	flagSet.StringVar(&flags.Checksum, "checksum", "", "Expected sha256:<hex> of template or archive fetched by url")
+	flagSet.BoolVar(&flags.RemoteHooks, "allow-remote-hooks", false, "Run hooks and validators of input dir fetched by url without checksum")
+	flagSet.BoolVar(&flags.Prune, "prune", false, "Remove outputs rendered by previous run, which are not rendered anymore")
+	flagSet.BoolVar(&flags.OCILayer, "oci-layer", false, "Write output dir as OCI layer tarball")
+	flagSet.StringVar(&flags.Owner, "owner", "", "Owner uid:gid of created dirs and files")
+	flagSet.BoolVar(&flags.SkipEmptyDirs, "skip-empty-dirs", false, "Do not create dirs without outputs")
+	flagSet.StringVar(&flags.Redact, "redact", "full", "Redact strategy for secret values (full, last:N, length, hmac)")
+	flagSet.StringVar(&flags.RedactKey, "redact-key", "", "Key file for hmac redact strategy")
+	flagSet.StringVar(&flags.SecretEnv, "secret-env", "", "Comma separated secret variables besides matched by name")
+	flagSet.StringVar(&flags.Only, "only", "", "Comma separated globs or tag:name of files to render")
+	flagSet.StringVar(&flags.Skip, "skip", "", "Comma separated globs or tag:name of files to skip")
+	flagSet.StringVar(&flags.ChangedSince, "changed-since", "", "Render only templates changed since git ref")
+	flagSet.BoolVar(&flags.Conflicts, "conflicts", false, "Report variables defined in several layers")
+	flagSet.BoolVar(&flags.FailOnShadow, "fail-on-shadow", false, "Fail when layers define different values of variable")
+	flagSet.StringVar(&flags.ShadowAllow, "shadow-allow", "", "Comma separated variables allowed to be shadowed")
+	flagSet.BoolVar(&flags.HomeMode, "home-mode", false, "Render dotfiles into home dir, mapping dot_ prefixes to '.'")
+	flagSet.StringVar(&flags.Users, "users", "", "Comma separated users to render into homes of in home mode")
+	flagSet.StringVar(&flags.DNSServer, "dns-server", "", "Address of DNS server used by dns functions instead of system resolver")
+	flagSet.DurationVar(&flags.DNSTimeout, "dns-timeout", defaultDNSTimeout, "Timeout of single DNS lookup")
+	flagSet.BoolVar(&flags.WarningsAsErrors, "warnings-as-errors", false, "Fail when templates report warnings")
+	flagSet.StringVar(&flags.Expected, "expected", "", "Dir with expected outputs, doctor compares rendered templates with it")
+	flagSet.StringVar(&flags.OM, "om", "template", "Output mode (template, ini, properties, xml)")
 
-	err := flagSet.Parse(os.Args[1:])
+	err := flagSet.Parse(args)
 	if err != nil {
 		return flags, err
 	}
 
+	// home mode renders into $HOME by default
+	if flags.HomeMode && flags.OD == "" && flags.Users == "" {
+		flags.OD, err = os.UserHomeDir()
+		if err != nil {
+			return flags, err
+		}
+	}
+
 	// validate
 	switch {
 	case flags.IF == "" && flags.ID == "":
 		err = fmt.Errorf("Required input file or input dir")
 	case flags.IF != "" && flags.OF == "":
 		err = fmt.Errorf("Required output file when using input file")
-	case flags.ID != "" && flags.OD == "":
+	case flags.Users != "" && !flags.HomeMode:
+		err = fmt.Errorf("Users can be used only in home mode")
+	case flags.HomeMode && flags.ID == "":
+		err = fmt.Errorf("Required input dir when using home mode")
+	case flags.HomeMode && flags.Users != "" && flags.OD != "":
+		err = fmt.Errorf("Output dirs are homes of users, output dir can't be used with users")
+	case flags.HomeMode && flags.SF == "":
+		err = fmt.Errorf("Required state file when using home mode, it tracks managed files")
+	case flags.HomeMode && (flags.OCILayer || isS3URL(flags.OD)):
+		err = fmt.Errorf("Home mode requires local output dir")
+	case flags.ID != "" && flags.OD == "" && flags.Users == "":
 		err = fmt.Errorf("Required output dir when using input dir")
+	case flags.OM != "template" && flags.OM != "ini" && flags.OM != "properties" && flags.OM != "xml":
+		err = fmt.Errorf("Unknown output mode '%v'", flags.OM)
+	case flags.Owner != "" && !validOwner(flags.Owner):
+		err = fmt.Errorf("Bad owner '%v', expected uid:gid", flags.Owner)
+	case flags.Prune && flags.SF == "":
+		err = fmt.Errorf("Required state file when using prune")
+	case flags.Prune && (isS3URL(flags.OD) || isS3URL(flags.OF)):
+		err = fmt.Errorf("Prune is not supported for s3 outputs")
+	case flags.OCILayer && (flags.ID == "" || isS3URL(flags.OD)):
+		err = fmt.Errorf("Required input dir and local output dir when using oci layer")
+	case flags.OCILayer && (flags.Only != "" || flags.Skip != "" || flags.ChangedSince != ""):
+		err = fmt.Errorf("Oci layer holds whole tree, it can't be used with only, skip or changed-since")
+	case flags.ChangedSince != "" && (flags.ID == "" || isHTTPURL(flags.ID)):
+		err = fmt.Errorf("Required local input dir when using changed-since")
 	}
 
 	return flags, err
@@ -241,76 +743,488 @@ type Flags struct {
 	ID string
 	OD string
 	EF string
+	SF string
+	OM string
+
+	Safe          bool
+	AllowEnv      string
+	Recipient     string
+	S3Endpoint    string
+	CacheDir      string
+	Checksum      string
+	RemoteHooks   bool
+	Prune         bool
+	OCILayer      bool
+	Owner         string
+	SkipEmptyDirs bool
+	Redact        string
+	RedactKey     string
+	SecretEnv     string
+
+	Only         string
+	Skip         string
+	ChangedSince string
+
+	Conflicts    bool
+	FailOnShadow bool
+	ShadowAllow  string
+
+	DNSServer  string
+	DNSTimeout time.Duration
+
+	WarningsAsErrors bool
+	Expected         string
+
+	HomeMode bool
+	Users    string
+	// user is set for each of users
+	user *HomeUser
 }
 
-func Run(flags Flags) error {
-	var err error
+// outputName returns output path relative to output root
+func outputName(flags Flags, outputPath string) string {
+	if flags.ID == "" {
+		return path.Base(filepath.ToSlash(outputPath))
+	}
+	name, err := filepath.Rel(flags.OD, outputPath)
+	if err != nil {
+		return filepath.ToSlash(outputPath)
+	}
+	return filepath.ToSlash(name)
+}
 
-	// copy dir struct if Required
-	if flags.ID != "" {
-		err = recursiveCopyDir(flags.ID, flags.OD)
-		if err != nil {
-			return err
+// findTemplates returns files to render, skipping ignored ones
+func findTemplates(tx *TemplateContext, flags Flags) ([]*TemplateFile, error) {
+	templateFiles := []*TemplateFile{}
+	if flags.ID == "" {
+		templateFile := NewTemplateFile(
+			tx,
+			filepath.Base(flags.OF),
+			flags.IF,
+			flags.OF,
+		)
+		templateFile.OutputMode = flags.OM
+		templateFile.Settings = defaultDirSettings()
+		templateFile.Settings.Owner = flags.Owner
+		return append(templateFiles, templateFile), nil
+	}
+
+	patterns, err := loadIgnore(flags.ID)
+	if err != nil {
+		return nil, err
+	}
+	root := defaultDirSettings()
+	root.Owner = flags.Owner
+	entries, err := recursiveGetTemplates(flags.ID, "", root)
+	if err != nil {
+		return nil, err
+	}
+
+	// subtrees with env files get own context
+	contexts := map[*DirSettings]*TemplateContext{}
+	for _, entry := range entries {
+		if ignored(patterns, entry.name) {
+			continue
+		}
+		settings := entry.settings
+		if tx.safe && (len(settings.Hooks) > 0 || len(settings.Validators) > 0) {
+			return nil, fmt.Errorf("%v: hooks and validators are not allowed in safe mode", entry.name)
+		}
+		// commands of fetched archive run only when archive is pinned
+		if tx.fetcher != nil && tx.fetcher.checksum == "" && !flags.RemoteHooks && (len(settings.Hooks) > 0 || len(settings.Validators) > 0) {
+			return nil, fmt.Errorf("%v: hooks and validators of input dir fetched by url require -checksum or -allow-remote-hooks", entry.name)
+		}
+
+		entryTx, ok := contexts[settings]
+		if !ok {
+			entryTx = tx
+			if len(settings.EnvFiles) > 0 {
+				entryTx = tx.clone()
+				for _, envFile := range settings.EnvFiles {
+					err = entryTx.loadEnvFile(envFile)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			contexts[settings] = entryTx
+		}
+
+		// with suffix only files having it are templates
+		outputName := entry.name
+		if settings.Suffix != "" {
+			if strings.HasSuffix(outputName, settings.Suffix) {
+				outputName = strings.TrimSuffix(outputName, settings.Suffix)
+			} else {
+				copied := *settings
+				copied.Engine = "none"
+				settings = &copied
+			}
 		}
+		if flags.HomeMode {
+			outputName = dotName(outputName)
+		}
+
+		templateFile := NewTemplateFile(
+			entryTx,
+			outputName,
+			filepath.Join(flags.ID, entry.name),
+			joinOutput(flags.OD, outputName),
+		)
+		templateFile.OutputMode = flags.OM
+		templateFile.Settings = settings
+		templateFiles = append(templateFiles, templateFile)
 	}
+	return templateFiles, nil
+}
 
+func Run(flags Flags, observer ...Observer) error {
+	var err error
+	notify := observers(observer)
+	if flags.HomeMode && flags.Users != "" {
+		return runUsers(flags, observer...)
+	}
+
+	start := time.Now()
 	tx := NewTemplateContext()
+	notify.done(EventSourceLoaded, "env", start, nil, nil)
+
+	if flags.HomeMode {
+		tx.user = flags.user
+		if tx.user == nil {
+			tx.user = currentHomeUser(flags.OD)
+		}
+	}
+
+	tx.redactor, err = NewRedactor(flags.Redact, flags.RedactKey, flags.SecretEnv)
+	if err != nil {
+		return notify.failed("redact", flags.SecretEnv, start, err)
+	}
+	tx.dns = newDNSResolver(flags.DNSServer, flags.DNSTimeout)
 
-	// load env file if exist
-	if flags.EF != "" {
-		err = tx.loadEnvFile(flags.EF)
+	// fetch remote input dir first, the rest works with local copy
+	start = time.Now()
+	url := flags.ID
+	err = resolveRemoteInput(tx, &flags)
+	if isHTTPURL(url) {
+		err = notify.done(EventSourceLoaded, url, start, nil, err)
+	}
+	if err != nil {
+		return notify.failed("input", url, start, err)
+	}
+
+	if isS3URL(flags.OD) || isS3URL(flags.OF) {
+		start = time.Now()
+		tx.s3, err = newS3Client(flags.S3Endpoint)
+		if err != nil {
+			return notify.failed("s3-client", flags.S3Endpoint, start, err)
+		}
+	}
+
+	// load env files if exist, later files override earlier ones
+	for _, envFile := range splitList(flags.EF) {
+		start = time.Now()
+		err = notify.done(EventSourceLoaded, envFile, start, nil, tx.loadEnvFile(envFile))
 		if err != nil {
 			return err
 		}
 	}
 
-	// find templates
-	templateFiles := []*TemplateFile{}
-	if flags.ID != "" {
-		files, err := recursiveGetFiles(flags.ID)
+	if flags.Safe {
+		tx.EnableSafeMode(flags.AllowEnv)
+	}
+
+	// load state file if required
+	if flags.SF != "" {
+		start = time.Now()
+		tx.state, err = LoadState(flags.SF)
+		err = notify.done(EventSourceLoaded, flags.SF, start, nil, err)
 		if err != nil {
 			return err
 		}
-		for _, file := range files {
-			templateFiles = append(templateFiles, NewTemplateFile(
-				tx,
-				filepath.Join(flags.ID, file),
-				filepath.Join(flags.OD, file),
-			))
+	}
+
+	inputPath := flags.ID
+	if inputPath == "" {
+		inputPath = flags.IF
+	}
+	start = time.Now()
+	templateFiles, err := findTemplates(tx, flags)
+	if err != nil {
+		return notify.failed("find-templates", inputPath, start, err)
+	}
+
+	// report variables defined in several layers
+	conflicts := Conflicts(contextsOf(tx, templateFiles)...)
+	if flags.Conflicts {
+		for _, c := range conflicts {
+			log.Printf("Conflict %v\n", c.Describe(tx.redactor))
+		}
+	}
+	if names := shadowed(conflicts, flags.ShadowAllow); flags.FailOnShadow && len(names) > 0 {
+		err = fmt.Errorf("Variables shadowed by other layers: %v", strings.Join(names, ", "))
+		return notify.failed("conflicts", flags.EF, start, err)
+	}
+
+	outputDir := flags.OD
+	if flags.ID == "" {
+		outputDir = filepath.Dir(flags.OF)
+		if isS3URL(flags.OF) {
+			outputDir = flags.OF[:strings.LastIndex(flags.OF, "/")]
 		}
-	} else {
-		templateFiles = append(templateFiles, NewTemplateFile(
-			tx,
-			flags.IF,
-			flags.OF,
-		))
 	}
 
 	// read, template, write all templates
 	for _, templateFile := range templateFiles {
+		start := time.Now()
 		err := templateFile.LoadInput()
+		err = notify.done(EventSourceLoaded, templateFile.InputPath, start, sizeMeta(templateFile.Input), err)
 		if err != nil {
 			return err
 		}
 	}
+
+	// select files to render, front matter tags are known after load
+	start = time.Now()
+	selector, err := newSelector(flags)
+	if err != nil {
+		return notify.failed("select", inputPath, start, err)
+	}
+	templateFiles, unselected := selector.split(templateFiles, flags.ID)
+	unselectedNames := []string{}
+	for _, templateFile := range unselected {
+		unselectedNames = append(unselectedNames, outputName(flags, templateFile.OutputPath))
+		notify.done(EventFileSkipped, templateFile.InputPath, time.Now(), map[string]string{"reason": "unselected"}, nil)
+	}
+	if selector.active() && !isS3URL(outputDir) {
+		err = tx.loadAssetManifest(outputDir)
+		if err != nil {
+			return notify.failed("asset-manifest", outputDir, start, err)
+		}
+	}
+
+	// nothing is created or rendered until all files have required variables
+	start = time.Now()
+	err = checkRequirements(templateFiles)
+	if err != nil {
+		return notify.failed("requirements", inputPath, start, err)
+	}
+
+	// copy dir struct if Required. Created dirs get their modes even when
+	// run fails, as next run doesn't change existing dirs.
+	createdDirs := []createdDir{}
+	defer func() { applyDirModes(createdDirs) }()
+	if flags.ID != "" && !isS3URL(flags.OD) && !flags.OCILayer {
+		opts := copyDirOptions{Owner: flags.Owner}
+		if flags.HomeMode {
+			opts.Rename = dotName
+		}
+		if flags.SkipEmptyDirs {
+			opts.Only = map[string]bool{}
+			for _, templateFile := range templateFiles {
+				for dir := path.Dir(outputName(flags, templateFile.OutputPath)); dir != "."; dir = path.Dir(dir) {
+					opts.Only[dir] = true
+				}
+			}
+		}
+		start = time.Now()
+		createdDirs, err = recursiveCopyDir(flags.ID, flags.OD, opts)
+		if err != nil {
+			return notify.failed("copy-dirs", flags.OD, start, err)
+		}
+	}
+
+	// layer is always built from scratch
 	for _, templateFile := range templateFiles {
-		err := templateFile.Template()
+		if flags.OCILayer {
+			break
+		}
+		start := time.Now()
+		err := templateFile.LoadCurrent()
+		if err != nil {
+			return notify.failed("load-current", templateFile.OutputPath, start, err)
+		}
+	}
+	for _, templateFile := range templateFiles {
+		start := time.Now()
+		err := notify.done(EventFileParsed, templateFile.InputPath, start, nil, templateFile.Parse())
 		if err != nil {
 			return err
 		}
 	}
+	// files with hashed names go first, so other files can refer them
+	for _, hashed := range []bool{true, false} {
+		for _, templateFile := range templateFiles {
+			if templateFile.HashName() != hashed {
+				continue
+			}
+			start := time.Now()
+			err := templateFile.Template()
+			if err == nil && hashed {
+				templateFile.applyHashName()
+			}
+			if err == nil && templateFile.Encrypt() {
+				err = templateFile.encryptOutput(flags.Recipient)
+			}
+			err = notify.done(EventFileRendered, templateFile.InputPath, start, sizeMeta(templateFile.Output), err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	start = time.Now()
+	err = reportDiagnostics(templateFiles, flags.WarningsAsErrors)
+	if err != nil {
+		return notify.failed("diagnostics", inputPath, start, err)
+	}
+	manifest, err := tx.assetManifest()
+	if err == nil {
+		err = checkAssetManifestName(flags, templateFiles, manifest)
+	}
+	if err != nil {
+		return notify.failed("asset-manifest", outputDir, start, err)
+	}
+
+	// files not rendered by previous run are backed up before replacing,
+	// nothing is written through symlinks of home user
 	for _, templateFile := range templateFiles {
-		err := templateFile.SaveOutput()
+		if !flags.HomeMode {
+			break
+		}
+		start := time.Now()
+		err := checkHomePath(outputDir, templateFile.OutputPath)
+		if err != nil {
+			return notify.failed("home-path", templateFile.OutputPath, start, err)
+		}
+		backup, err := templateFile.backupUnmanaged(outputDir, outputName(flags, templateFile.OutputPath))
+		if backup != "" || err != nil {
+			err = notify.done(EventFileWritten, backup, start, map[string]string{"backup": templateFile.OutputPath}, err)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
+	// outputs of previous run, which are not rendered anymore
+	pruned := []string{}
+	if tx.state != nil {
+		names := []string{}
+		for _, templateFile := range templateFiles {
+			names = append(names, outputName(flags, templateFile.OutputPath))
+		}
+		if manifest != nil {
+			names = append(names, assetManifestName)
+		}
+		pruned = tx.state.replaceOutputs(outputDir, names, unselectedNames)
+	}
+	if !flags.Prune {
+		pruned = nil
+	}
+
+	if flags.OCILayer {
+		start = time.Now()
+		err = writeOCILayer(flags, templateFiles, manifest, pruned)
+		err = notify.done(EventFileWritten, flags.OD, start, nil, err)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, templateFile := range templateFiles {
+			start := time.Now()
+			err := templateFile.SaveOutput()
+			kind := EventFileWritten
+			if templateFile.Skipped {
+				kind = EventFileSkipped
+			}
+			err = notify.done(kind, templateFile.OutputPath, start, sizeMeta(templateFile.Output), err)
+			if err != nil {
+				return err
+			}
+		}
+
+		start = time.Now()
+		err = tx.saveAssetManifest(outputDir, manifest)
+		if err != nil {
+			return notify.failed("asset-manifest", outputDir, start, err)
+		}
+
+		err = runHooks(templateFiles, notify)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range pruned {
+			start := time.Now()
+			prunedPath := filepath.Join(outputDir, filepath.FromSlash(name))
+			var err error
+			if flags.HomeMode {
+				// Remove does not follow last element, but does follow dirs
+				err = checkHomePath(outputDir, filepath.Dir(prunedPath))
+			}
+			if err == nil {
+				err = os.Remove(prunedPath)
+			}
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			err = notify.done(EventFileWritten, filepath.Join(outputDir, name), start, map[string]string{"pruned": "true"}, err)
+			if err != nil {
+				return err
+			}
+		}
+
+		start = time.Now()
+		err = applyDirModes(createdDirs)
+		createdDirs = nil
+		if err != nil {
+			return notify.failed("dir-modes", flags.OD, start, err)
+		}
+	}
+
+	if tx.state != nil {
+		start = time.Now()
+		return notify.done(EventFileWritten, flags.SF, start, nil, tx.state.Save())
+	}
 	return nil
 }
 
 func main() {
-	flags, err := NewFlags()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "decrypt-outputs":
+			err := DecryptOutputs(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Failed decrypt outputs: %v\n", err)
+			}
+			return
+		case "init":
+			err := Init(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Failed init: %v\n", err)
+			}
+			return
+		case "doctor":
+			err := Doctor(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Failed doctor: %v\n", err)
+			}
+			return
+		case "extract":
+			err := Extract(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Failed extract: %v\n", err)
+			}
+			return
+		case "adopt":
+			err := Adopt(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Failed adopt: %v\n", err)
+			}
+			return
+		}
+	}
+
+	flags, err := NewFlags(os.Args[1:])
 	if err != nil {
 		log.Fatalf("Failed parse flags: %v\n", err)
 	}
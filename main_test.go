@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRunMirrorsOnlyCreatedDirs(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	writeFiles(t, dir, map[string]string{
+		"in/.ssh/config":   `Host *`,
+		"in/ro/a.conf":     `a`,
+		"in/ro/sub/b.conf": `b`,
+	})
+	for path, perm := range map[string]os.FileMode{"in": 0775, "in/.ssh": 0775, "in/ro": 0555, "in/ro/sub": 0555} {
+		err := os.Chmod(filepath.Join(dir, path), perm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(out, "ro/sub"), 0775)
+		os.Chmod(filepath.Join(out, "ro"), 0775)
+		os.Chmod(filepath.Join(in, "ro/sub"), 0775)
+		os.Chmod(filepath.Join(in, "ro"), 0775)
+	})
+	err := os.MkdirAll(filepath.Join(out, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"-id", in, "-od", out}
+	if os.Getuid() == 0 {
+		args = append(args, "-owner", "1234:5678")
+	}
+	flags, err := NewFlags(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Run(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		perm    os.FileMode
+		created bool
+	}{
+		{".ssh", 0700, false},
+		{"ro", 0555, true},
+		{"ro/sub", 0555, true},
+	}
+	for _, tt := range tests {
+		info, err := os.Stat(filepath.Join(out, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != tt.perm {
+			t.Errorf("%v: got mode %v, want %v", tt.path, info.Mode().Perm(), tt.perm)
+		}
+		if os.Getuid() != 0 {
+			continue
+		}
+		uid := info.Sys().(*syscall.Stat_t).Uid
+		if tt.created && uid != 1234 || !tt.created && uid != 0 {
+			t.Errorf("%v: got owner %v", tt.path, uid)
+		}
+	}
+	for _, name := range []string{".ssh/config", "ro/a.conf", "ro/sub/b.conf"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRecursiveCopyDirKeepsCreatedDirsWritable(t *testing.T) {
+	dir := t.TempDir()
+	src, rmt := filepath.Join(dir, "src"), filepath.Join(dir, "rmt")
+	err := os.MkdirAll(filepath.Join(src, "ro"), 0775)
+	if err == nil {
+		err = os.Chmod(filepath.Join(src, "ro"), 0555)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := recursiveCopyDir(src, rmt, copyDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 2 {
+		t.Fatalf("got %v created dirs, want 2", len(created))
+	}
+	info, err := os.Stat(filepath.Join(rmt, "ro"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0700 != 0700 {
+		t.Errorf("got mode %v before applyDirModes, want writable by owner", info.Mode().Perm())
+	}
+
+	err = applyDirModes(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(filepath.Join(rmt, "ro"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0555 {
+		t.Errorf("got mode %v, want %v", info.Mode().Perm(), os.FileMode(0555))
+	}
+}
+
+func TestWriteFileAtomicKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	target, link := filepath.Join(dir, "server.xml"), filepath.Join(dir, "link.xml")
+	err := os.WriteFile(target, []byte("old"), 0640)
+	if err == nil {
+		err = os.Symlink("server.xml", link)
+	}
+	if err == nil && os.Getuid() == 0 {
+		err = os.Chown(target, 1234, 5678)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeFileAtomic(link, []byte("new"), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink is replaced: %v", err)
+	}
+	b, err := os.ReadFile(target)
+	if err != nil || string(b) != "new" {
+		t.Errorf("got %q, %v, want new content in target", b, err)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("got mode %v, want %v", info.Mode().Perm(), os.FileMode(0640))
+	}
+	if stat := info.Sys().(*syscall.Stat_t); os.Getuid() == 0 && (stat.Uid != 1234 || stat.Gid != 5678) {
+		t.Errorf("got owner %v:%v, want 1234:5678", stat.Uid, stat.Gid)
+	}
+}
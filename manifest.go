@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dir manifests
+//
+// Any dir under input dir may have .envtemplater.toml with defaults for its
+// subtree. Settings of deeper manifests override settings of shallower ones
+// key by key:
+//
+//	engine = "text"              # "text" for text/template, "none" to copy as is
+//	delimiters = ["[[", "]]"]
+//	suffix = ".tmpl"             # only files with suffix are templates, suffix
+//	                             # is stripped from output name
+//	mode = "0640"                # mode of outputs
+//	owner = "1000:1000"          # owner of outputs
+//	env_files = ["team.env"]     # relative to manifest dir, not rendered
+//	validators = ["nginx -t -c {}"]
+//	hooks = ["systemctl reload nginx"]
+//	tags = ["web"]               # used by -only and -skip
+//	requires = ["PORT:int"]      # schema of variables, see Requirement
+//
+// Validators are run before output is saved, with {} replaced by path of file
+// holding new content. Hooks are run once after all outputs are saved, when
+// any output of the subtree has changed. Both are denied in safe mode and for
+// input dir fetched by url, unless it is pinned by -checksum or
+// -allow-remote-hooks is given.
+const manifestFileName = ".envtemplater.toml"
+
+type DirSettings struct {
+	Engine     string
+	LeftDelim  string
+	RightDelim string
+	Suffix     string
+	Mode       os.FileMode
+	Owner      string
+	EnvFiles   []string
+	Validators []string
+	Hooks      []string
+	Tags       []string
+	Requires   []Requirement
+}
+
+func defaultDirSettings() *DirSettings {
+	return &DirSettings{Engine: "text"}
+}
+
+// loadDirSettings returns settings of dir, parent is returned as is when dir
+// has no manifest
+func loadDirSettings(dir string, parent *DirSettings) (*DirSettings, error) {
+	path := filepath.Join(dir, manifestFileName)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return parent, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseTOML(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	settings := *parent
+	for key, value := range values {
+		err = settings.set(dir, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return &settings, nil
+}
+
+func (s *DirSettings) set(dir, key string, value interface{}) error {
+	str, isStr := value.(string)
+	list, isList := value.([]string)
+	n, isInt := value.(int64)
+	switch {
+	case key == "engine" && isStr && (str == "text" || str == "none"):
+		s.Engine = str
+	case key == "delimiters" && isList && len(list) == 2:
+		s.LeftDelim, s.RightDelim = list[0], list[1]
+	case key == "suffix" && isStr:
+		s.Suffix = str
+	case key == "mode" && isStr:
+		mode, err := strconv.ParseUint(str, 8, 32)
+		if err != nil {
+			return fmt.Errorf("Bad mode '%v'", str)
+		}
+		s.Mode = os.FileMode(mode).Perm()
+	case key == "mode" && isInt:
+		s.Mode = os.FileMode(n).Perm()
+	case key == "owner" && isStr:
+		_, _, err := parseOwner(str)
+		if err != nil {
+			return err
+		}
+		s.Owner = str
+	case key == "env_files" && isList:
+		s.EnvFiles = []string{}
+		for _, file := range list {
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			s.EnvFiles = append(s.EnvFiles, file)
+		}
+	case key == "validators" && isList:
+		s.Validators = list
+	case key == "hooks" && isList:
+		s.Hooks = list
+	case key == "tags" && isList:
+		s.Tags = list
+	case key == "requires" && isList:
+		requirements, err := parseRequirements(strings.Join(list, " "))
+		if err != nil {
+			return err
+		}
+		s.Requires = requirements
+	default:
+		return fmt.Errorf("Unknown key or bad value '%v = %v'", key, value)
+	}
+	return nil
+}
+
+type templateEntry struct {
+	name     string
+	settings *DirSettings
+}
+
+// recursiveGetTemplates is recursiveGetFiles, which also carries settings of
+// dir manifests down to files. Manifests and env files they list are not
+// templates.
+func recursiveGetTemplates(root, name string, parent *DirSettings) ([]templateEntry, error) {
+	path := filepath.Join(root, name)
+	settings, err := loadDirSettings(path, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []templateEntry{}
+	for _, entry := range entries {
+		entryName := filepath.Join(name, entry.Name())
+		if !entry.IsDir() {
+			if entry.Name() != manifestFileName && !settings.isEnvFile(filepath.Join(root, entryName)) {
+				files = append(files, templateEntry{entryName, settings})
+			}
+			continue
+		}
+
+		subfiles, err := recursiveGetTemplates(root, entryName, settings)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, subfiles...)
+	}
+	return files, nil
+}
+
+func (s *DirSettings) isEnvFile(path string) bool {
+	path, _ = filepath.Abs(path)
+	for _, file := range s.EnvFiles {
+		if file, _ = filepath.Abs(file); file == path {
+			return true
+		}
+	}
+	return false
+}
+
+// validate runs validators of file against content before it is saved
+func (tf *TemplateFile) validate(output string) error {
+	if len(tf.Settings.Validators) == 0 {
+		return nil
+	}
+	f, err := os.CreateTemp("", "envtemplater-*"+filepath.Ext(tf.OutputPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(output)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, validator := range tf.Settings.Validators {
+		command := validator
+		if strings.Contains(command, "{}") {
+			command = strings.ReplaceAll(command, "{}", f.Name())
+		} else {
+			command += " " + f.Name()
+		}
+		out, err := runCommand(command)
+		if err != nil {
+			return fmt.Errorf("%v: validator '%v' failed: %v\n%s", tf.OutputPath, validator, err, out)
+		}
+	}
+	return nil
+}
+
+func runCommand(command string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+	err := cmd.Run()
+	return buf.Bytes(), err
+}
+
+// TOML subset
+//
+// Manifests support top level "key = value" pairs with strings, integers,
+// booleans and arrays of strings. Tables are not supported.
+func parseTOML(s string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(stripTOMLComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("Line %v: tables are not supported", i+1)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("Line %v: expected key = value", i+1)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		value = strings.TrimSpace(value)
+
+		// arrays may span several lines
+		start := i
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripTOMLComment(lines[i]))
+		}
+
+		v, err := parseTOMLValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Line %v: %v", start+1, err)
+		}
+		values[key] = v
+	}
+	return values, nil
+}
+
+// stripTOMLComment removes comment outside of strings
+func stripTOMLComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(value string) (interface{}, error) {
+	switch {
+	case value == "true" || value == "false":
+		return value == "true", nil
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) > 1:
+		return value[1 : len(value)-1], nil
+	case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+		list := []string{}
+		for _, item := range splitTOMLArray(value[1 : len(value)-1]) {
+			v, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			str, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("Only arrays of strings are supported")
+			}
+			list = append(list, str)
+		}
+		return list, nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(value, "_", ""), 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Bad value '%v'", value)
+	}
+	return n, nil
+}
+
+func splitTOMLArray(s string) []string {
+	items := []string{}
+	quote, start := byte(0), 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	items = append(items, s[start:])
+
+	trimmed := []string{}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			trimmed = append(trimmed, item)
+		}
+	}
+	return trimmed
+}
+
+// runHooks runs hooks of subtrees with changed outputs, each command once
+func runHooks(templateFiles []*TemplateFile, notify observers) error {
+	seen := map[string]bool{}
+	for _, templateFile := range templateFiles {
+		if !templateFile.Changed {
+			continue
+		}
+		for _, hook := range templateFile.Settings.Hooks {
+			if seen[hook] {
+				continue
+			}
+			seen[hook] = true
+
+			start := time.Now()
+			out, err := runCommand(hook)
+			if err != nil {
+				err = fmt.Errorf("Hook '%v' failed: %v\n%s", hook, err, out)
+			}
+			err = notify.done(EventHookRun, templateFile.OutputPath, start, map[string]string{"command": hook}, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:  "scalars",
+			input: "engine = \"text\"\nmode = 0o640\nsize = 1_000\nstrict = true\nsuffix = '.tmpl'\n",
+			want: map[string]interface{}{
+				"engine": "text", "mode": int64(0640), "size": int64(1000), "strict": true, "suffix": ".tmpl",
+			},
+		},
+		{
+			name:  "comments outside of strings",
+			input: "# defaults\nowner = \"0:0\" # root\nhook = \"echo '#1' # not a comment\"\n",
+			want:  map[string]interface{}{"owner": "0:0", "hook": "echo '#1' # not a comment"},
+		},
+		{
+			name:  "quoted key and escapes",
+			input: `"tags" = ["a\"b", 'c,d']`,
+			want:  map[string]interface{}{"tags": []string{`a"b`, "c,d"}},
+		},
+		{
+			name:  "array over several lines",
+			input: "hooks = [\n  \"a\", # first\n  \"b\",\n]\n",
+			want:  map[string]interface{}{"hooks": []string{"a", "b"}},
+		},
+		{
+			name:  "empty array",
+			input: "tags = []",
+			want:  map[string]interface{}{"tags": []string{}},
+		},
+		{name: "table", input: "[section]\n", wantErr: true},
+		{name: "missing value", input: "engine\n", wantErr: true},
+		{name: "array of integers", input: "tags = [1, 2]", wantErr: true},
+		{name: "bad value", input: "mode = rw", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestEnvFilesAreNotTemplates(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	writeFiles(t, dir, map[string]string{
+		"in/team/" + manifestFileName: "env_files = [\"team.env\", \"env/extra.env\"]\n",
+		"in/team/team.env":            "A=1\n",
+		"in/team/env/extra.env":       "B=2\n",
+		"in/team/a.conf":              `{{ .Env "A" }}{{ .Env "B" }}`,
+	})
+
+	flags, err := NewFlags([]string{"-id", in, "-od", out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Run(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(out, "team/a.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "12" {
+		t.Errorf("got %q, want %q", b, "12")
+	}
+	for _, name := range []string{"team/team.env", "team/env/extra.env"} {
+		if _, err := os.Stat(filepath.Join(out, name)); !os.IsNotExist(err) {
+			t.Errorf("%v: env file rendered as template", name)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Render events
+//
+// Observers get an event for every step of Run, so code using envtemplater
+// as library can collect its own telemetry.
+type EventKind string
+
+const (
+	// environment, env file, state file or template input was loaded
+	EventSourceLoaded EventKind = "source-loaded"
+	EventFileParsed   EventKind = "file-parsed"
+	EventFileRendered EventKind = "file-rendered"
+	EventFileWritten  EventKind = "file-written"
+	EventFileSkipped  EventKind = "file-skipped"
+	// hook of dir manifest was run, Meta["command"] holds the command
+	EventHookRun EventKind = "hook-run"
+	// step failed, Meta["step"] holds kind of failed step or name of step,
+	// which has no event of its own, e.g. "requirements" or "copy-dirs"
+	EventError EventKind = "error"
+)
+
+type Event struct {
+	Kind     EventKind
+	Path     string
+	Time     time.Time
+	Duration time.Duration
+	Meta     map[string]string
+	Err      error
+}
+
+type Observer interface {
+	Observe(event Event)
+}
+
+// ObserverFunc adapts function to Observer
+type ObserverFunc func(event Event)
+
+func (f ObserverFunc) Observe(event Event) {
+	f(event)
+}
+
+// ChanObserver sends events to channel, it blocks when channel is full
+type ChanObserver chan Event
+
+func (c ChanObserver) Observe(event Event) {
+	c <- event
+}
+
+type observers []Observer
+
+// done notifies observers about step started at start and passes err through
+func (o observers) done(kind EventKind, path string, start time.Time, meta map[string]string, err error) error {
+	if len(o) == 0 {
+		return err
+	}
+	if err != nil {
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta["step"] = string(kind)
+		kind = EventError
+	}
+	o.emit(kind, path, start, meta, err)
+	return err
+}
+
+// failed notifies observers about failure of step, which has no event of
+// its own, and passes err through
+func (o observers) failed(step, path string, start time.Time, err error) error {
+	if err != nil && len(o) > 0 {
+		o.emit(EventError, path, start, map[string]string{"step": step}, err)
+	}
+	return err
+}
+
+func (o observers) emit(kind EventKind, path string, start time.Time, meta map[string]string, err error) {
+	event := Event{
+		Kind:     kind,
+		Path:     path,
+		Time:     start,
+		Duration: time.Since(start),
+		Meta:     meta,
+		Err:      err,
+	}
+	for _, observer := range o {
+		observer.Observe(event)
+	}
+}
+
+func sizeMeta(s string) map[string]string {
+	return map[string]string{"bytes": strconv.Itoa(len(s))}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0775)
+		if err == nil {
+			err = os.WriteFile(path, []byte(content), 0664)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type recordedEvent struct {
+	Kind EventKind
+	Path string
+	Step string
+}
+
+func runObserved(t *testing.T, args ...string) ([]recordedEvent, error) {
+	t.Helper()
+	flags, err := NewFlags(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []recordedEvent{}
+	err = Run(flags, ObserverFunc(func(e Event) {
+		if e.Kind == EventError && e.Err == nil {
+			t.Errorf("error event without error: %+v", e)
+		}
+		events = append(events, recordedEvent{e.Kind, e.Path, e.Meta["step"]})
+	}))
+	return events, err
+}
+
+func TestRunEvents(t *testing.T) {
+	dir := t.TempDir()
+	in, out, env := filepath.Join(dir, "in"), filepath.Join(dir, "out"), filepath.Join(dir, "a.env")
+	writeFiles(t, dir, map[string]string{
+		"in/a.conf":     `a={{ .Env "A" }}`,
+		"in/sub/b.conf": `b`,
+		"a.env":         "A=1\n",
+	})
+
+	events, err := runObserved(t, "-id", in, "-od", out, "-ef", env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []recordedEvent{
+		{EventSourceLoaded, "env", ""},
+		{EventSourceLoaded, env, ""},
+		{EventSourceLoaded, filepath.Join(in, "a.conf"), ""},
+		{EventSourceLoaded, filepath.Join(in, "sub/b.conf"), ""},
+		{EventFileParsed, filepath.Join(in, "a.conf"), ""},
+		{EventFileParsed, filepath.Join(in, "sub/b.conf"), ""},
+		{EventFileRendered, filepath.Join(in, "a.conf"), ""},
+		{EventFileRendered, filepath.Join(in, "sub/b.conf"), ""},
+		{EventFileWritten, filepath.Join(out, "a.conf"), ""},
+		{EventFileWritten, filepath.Join(out, "sub/b.conf"), ""},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events\n%v\nwant\n%v", events, want)
+	}
+}
+
+func TestRunErrorEvents(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"parse.tmpl":                 `{{ .Env "A"`,
+		"render.tmpl":                `{{ .Env "MISSING_VARIABLE_OF_TEST" }}`,
+		"requires.tmpl":              `{{/* requires: MISSING_VARIABLE_OF_TEST */}}`,
+		"warn.tmpl":                  `{{ warn "old" }}`,
+		"fail.tmpl":                  `{{ fail "broken" }}`,
+		"bad/" + manifestFileName:    `mode = rw`,
+		"assets/app.js":              "{{/*---\nhashName: true\n---*/}}\napp",
+		"assets/manifest.json":       `{}`,
+		"file":                       ``,
+		"shadow/" + manifestFileName: `env_files = ["b.env"]`,
+		"shadow/b.env":               "A=2\n",
+		"shadow/a.conf":              `{{ .Env "A" }}`,
+		"a.env":                      "A=1\n",
+		"unused/" + manifestFileName: ``,
+	})
+
+	tests := []struct {
+		args []string
+		want recordedEvent
+	}{
+		{
+			[]string{"-if", filepath.Join(dir, "missing.tmpl"), "-of", filepath.Join(dir, "out")},
+			recordedEvent{EventError, filepath.Join(dir, "missing.tmpl"), string(EventSourceLoaded)},
+		},
+		{
+			[]string{"-if", filepath.Join(dir, "parse.tmpl"), "-of", filepath.Join(dir, "out")},
+			recordedEvent{EventError, filepath.Join(dir, "parse.tmpl"), string(EventFileParsed)},
+		},
+		{
+			[]string{"-if", filepath.Join(dir, "render.tmpl"), "-of", filepath.Join(dir, "out")},
+			recordedEvent{EventError, filepath.Join(dir, "render.tmpl"), string(EventFileRendered)},
+		},
+		{
+			[]string{"-if", filepath.Join(dir, "render.tmpl"), "-of", filepath.Join(dir, "out"), "-ef", filepath.Join(dir, "missing.env")},
+			recordedEvent{EventError, filepath.Join(dir, "missing.env"), string(EventSourceLoaded)},
+		},
+		{
+			[]string{"-if", filepath.Join(dir, "fail.tmpl"), "-of", filepath.Join(dir, "out")},
+			recordedEvent{EventError, filepath.Join(dir, "fail.tmpl"), "diagnostics"},
+		},
+		{
+			[]string{"-if", filepath.Join(dir, "requires.tmpl"), "-of", filepath.Join(dir, "out")},
+			recordedEvent{EventError, filepath.Join(dir, "requires.tmpl"), "requirements"},
+		},
+		{
+			[]string{"-if", filepath.Join(dir, "warn.tmpl"), "-of", filepath.Join(dir, "out"), "-warnings-as-errors"},
+			recordedEvent{EventError, filepath.Join(dir, "warn.tmpl"), "diagnostics"},
+		},
+		{
+			[]string{"-id", filepath.Join(dir, "bad"), "-od", filepath.Join(dir, "out")},
+			recordedEvent{EventError, filepath.Join(dir, "bad"), "find-templates"},
+		},
+		{
+			[]string{"-id", filepath.Join(dir, "unused"), "-od", filepath.Join(dir, "out"), "-changed-since", "HEAD"},
+			recordedEvent{EventError, filepath.Join(dir, "unused"), "select"},
+		},
+		{
+			[]string{"-id", filepath.Join(dir, "unused"), "-od", filepath.Join(dir, "file", "out")},
+			recordedEvent{EventError, filepath.Join(dir, "file", "out"), "copy-dirs"},
+		},
+		{
+			[]string{"-id", filepath.Join(dir, "assets"), "-od", filepath.Join(dir, "out")},
+			recordedEvent{EventError, filepath.Join(dir, "out"), "asset-manifest"},
+		},
+		{
+			[]string{"-id", filepath.Join(dir, "shadow"), "-od", filepath.Join(dir, "out"), "-ef", filepath.Join(dir, "a.env"), "-fail-on-shadow"},
+			recordedEvent{EventError, filepath.Join(dir, "a.env"), "conflicts"},
+		},
+	}
+	for _, tt := range tests {
+		events, err := runObserved(t, tt.args...)
+		if err == nil {
+			t.Errorf("%v: expected error", tt.args)
+			continue
+		}
+		if got := events[len(events)-1]; got != tt.want {
+			t.Errorf("%v: got last event %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestChanObserver(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.tmpl": "a"})
+	flags, err := NewFlags([]string{"-if", filepath.Join(dir, "a.tmpl"), "-of", filepath.Join(dir, "a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(ChanObserver, 100)
+	err = Run(flags, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+	kinds := []EventKind{}
+	for e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+	want := []EventKind{EventSourceLoaded, EventSourceLoaded, EventFileParsed, EventFileRendered, EventFileWritten}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got %v, want %v", kinds, want)
+	}
+}
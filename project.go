@@ -0,0 +1,307 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Project scaffolding
+//
+// init subcommand creates starter layout of a project:
+//
+//	templates/                input dir with example template
+//	templates/.envtemplater.toml manifest, its requires key is schema of
+//	                          variables checked before rendering
+//	templates/.envtemplaterignore
+//	env/default.env           env file
+//	testdata/default/expected expected output for default.env, compared
+//	                          with rendered templates by doctor -expected
+var initFiles = []struct {
+	path    string
+	content string
+}{
+	{"templates/example.conf", `# Rendered by envtemplater, do not edit by hand.
+listen = {{ .Env "LISTEN" }}
+workers = {{ .Env "WORKERS" }}
+`},
+	{"templates/" + manifestFileName, `# Defaults for templates in this dir and below
+mode = "0644"
+tags = ["example"]
+
+# Schema: variables required by templates, as NAME:type
+requires = ["LISTEN:string", "WORKERS:int"]
+`},
+	{"templates/" + ignoreFileName, `# Files in input dir, which are not templates
+*.swp
+*~
+`},
+	{"env/default.env", `LISTEN=0.0.0.0:8080
+WORKERS=4
+`},
+	{"testdata/default/expected/example.conf", `# Rendered by envtemplater, do not edit by hand.
+listen = 0.0.0.0:8080
+workers = 4
+`},
+}
+
+func Init(args []string) error {
+	flagSet := flag.NewFlagSet("envtemplater init", flag.ContinueOnError)
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+	root := flagSet.Arg(0)
+	if root == "" {
+		root = "."
+	}
+
+	// never overwrite existing project
+	for _, file := range initFiles {
+		path := filepath.Join(root, file.path)
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("File '%v' already exists", path)
+		}
+	}
+
+	for _, file := range initFiles {
+		path := filepath.Join(root, file.path)
+		err = os.MkdirAll(filepath.Dir(path), 0775)
+		if err != nil {
+			return err
+		}
+		// env files may hold secrets
+		perm := os.FileMode(0664)
+		if strings.HasSuffix(path, ".env") {
+			perm = 0640
+		}
+		err = os.WriteFile(path, []byte(file.content), perm)
+		if err != nil {
+			return err
+		}
+		fmt.Println("created", path)
+	}
+	render := fmt.Sprintf("-id %v -od %v -ef %v",
+		filepath.Join(root, "templates"), filepath.Join(root, "out"), filepath.Join(root, "env/default.env"))
+	fmt.Printf("render with: envtemplater %v\n", render)
+	fmt.Printf("check with: envtemplater doctor %v -expected %v\n", render, filepath.Join(root, "testdata/default/expected"))
+	return nil
+}
+
+// Project checks
+//
+// doctor subcommand takes the same flags as render and reports problems
+// found in project, most severe first.
+type severity int
+
+const (
+	severityError severity = iota
+	severityWarning
+	severityInfo
+)
+
+func (s severity) String() string {
+	return [...]string{"error", "warning", "info"}[s]
+}
+
+type finding struct {
+	severity severity
+	path     string
+	message  string
+}
+
+type report []finding
+
+func (r *report) add(s severity, path, format string, a ...interface{}) {
+	*r = append(*r, finding{s, path, fmt.Sprintf(format, a...)})
+}
+
+func (r report) count(s severity) int {
+	n := 0
+	for _, f := range r {
+		if f.severity == s {
+			n++
+		}
+	}
+	return n
+}
+
+func (r report) print() {
+	sort.SliceStable(r, func(i, j int) bool { return r[i].severity < r[j].severity })
+	for _, f := range r {
+		fmt.Printf("%-7v %v: %v\n", f.severity, f.path, f.message)
+	}
+	fmt.Printf("%v errors, %v warnings\n", r.count(severityError), r.count(severityWarning))
+}
+
+func Doctor(args []string) error {
+	flags, err := NewFlags(args)
+	if err != nil {
+		return err
+	}
+
+	r := report{}
+	tx := NewTemplateContext()
+	tx.redactor, err = NewRedactor(flags.Redact, flags.RedactKey, flags.SecretEnv)
+	if err != nil {
+		return err
+	}
+	err = resolveRemoteInput(tx, &flags)
+	if err != nil {
+		r.add(severityError, flags.ID, "can't fetch templates: %v", err)
+	}
+	for _, envFile := range splitList(flags.EF) {
+		checkEnvFile(&r, tx, envFile)
+	}
+	if flags.Safe {
+		tx.EnableSafeMode(flags.AllowEnv)
+	}
+
+	templateFiles, err := findTemplates(tx, flags)
+	if err != nil {
+		r.add(severityError, flags.ID, "can't list templates: %v", err)
+	}
+	for _, c := range Conflicts(contextsOf(tx, templateFiles)...) {
+		s := severityInfo
+		if c.Differ {
+			s = severityWarning
+		}
+		r.add(s, c.Sources[len(c.Sources)-1].Layer, "variable %v", c.Describe(tx.redactor))
+	}
+	checkedDirs := map[string]bool{}
+	for _, templateFile := range templateFiles {
+		if checkTemplate(&r, templateFile) && flags.Expected != "" {
+			checkExpected(&r, templateFile, filepath.Join(flags.Expected, outputName(flags, templateFile.OutputPath)))
+		}
+
+		dir := filepath.Dir(templateFile.OutputPath)
+		if !checkedDirs[dir] && !isS3URL(templateFile.OutputPath) {
+			checkedDirs[dir] = true
+			checkOutputDir(&r, dir)
+		}
+	}
+
+	r.print()
+	if n := r.count(severityError); n > 0 {
+		return fmt.Errorf("Found %v errors", n)
+	}
+	return nil
+}
+
+func checkMode(r *report, path, what string, secret bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	mode := info.Mode().Perm()
+	if mode&0002 != 0 {
+		r.add(severityWarning, path, "%v is writable by others (%v)", what, mode)
+	}
+	if secret && mode&0004 != 0 {
+		r.add(severityWarning, path, "%v is readable by others (%v)", what, mode)
+	}
+}
+
+func checkEnvFile(r *report, tx *TemplateContext, path string) {
+	err := tx.loadEnvFile(path)
+	if err != nil {
+		r.add(severityError, path, "can't read env file: %v", err)
+		return
+	}
+	checkMode(r, path, "env file", true)
+}
+
+// checkTemplate returns true when template can be rendered
+func checkTemplate(r *report, tf *TemplateFile) bool {
+	err := tf.LoadInput()
+	if err != nil {
+		r.add(severityError, tf.InputPath, "can't read template: %v", err)
+		return false
+	}
+	checkMode(r, tf.InputPath, "template", false)
+
+	ok := true
+	err = tf.Parse()
+	if err != nil {
+		r.add(severityError, tf.InputPath, "%v", strings.TrimPrefix(err.Error(), "template: "))
+		ok = false
+	}
+	for _, problem := range tf.unmetRequirements() {
+		r.add(severityError, tf.InputPath, "required variable %v", problem)
+		ok = false
+	}
+
+	if tf.Encrypt() {
+		return false
+	}
+	checkMode(r, tf.OutputPath, "output", false)
+	return ok
+}
+
+// checkExpected renders template and compares result with expected output
+func checkExpected(r *report, tf *TemplateFile, expectedPath string) {
+	expected, err := os.ReadFile(expectedPath)
+	if os.IsNotExist(err) {
+		r.add(severityWarning, tf.InputPath, "no expected output '%v'", expectedPath)
+		return
+	}
+	if err != nil {
+		r.add(severityError, expectedPath, "can't read expected output: %v", err)
+		return
+	}
+
+	err = tf.LoadCurrent()
+	if err == nil {
+		err = tf.Template()
+	}
+	output := ""
+	if err == nil {
+		output, err = tf.FinalOutput()
+	}
+	if err != nil {
+		r.add(severityError, tf.InputPath, "can't render: %v", strings.TrimPrefix(err.Error(), "template: "))
+		return
+	}
+
+	if output == string(expected) {
+		return
+	}
+	got, want := strings.Split(output, "\n"), strings.Split(string(expected), "\n")
+	line := 0
+	for line < len(got) && line < len(want) && got[line] == want[line] {
+		line++
+	}
+	r.add(severityError, tf.InputPath, "output differs from '%v' at line %v", expectedPath, line+1)
+}
+
+func checkOutputDir(r *report, dir string) {
+	// dir may be created while rendering, check nearest existing one
+	existing := dir
+	for {
+		_, err := os.Stat(existing)
+		if err == nil || filepath.Dir(existing) == existing {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+
+	info, err := os.Stat(existing)
+	if err != nil {
+		r.add(severityError, dir, "output dir is not accessible: %v", err)
+		return
+	}
+	if !info.IsDir() {
+		r.add(severityError, dir, "'%v' is not a dir", existing)
+		return
+	}
+	f, err := os.CreateTemp(existing, ".envtemplater-doctor-*")
+	if err != nil {
+		r.add(severityError, dir, "output dir is not writable: %v", err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitProjectPassesDoctor(t *testing.T) {
+	root := t.TempDir()
+	err := Init([]string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Init([]string{root}); err == nil {
+		t.Error("expected error initializing existing project")
+	}
+
+	args := []string{
+		"-id", filepath.Join(root, "templates"),
+		"-od", filepath.Join(root, "out"),
+		"-ef", filepath.Join(root, "env/default.env"),
+		"-expected", filepath.Join(root, "testdata/default/expected"),
+	}
+	err = Doctor(args)
+	if err != nil {
+		t.Fatalf("doctor of new project: %v", err)
+	}
+
+	// fixture must match rendered output
+	writeFiles(t, root, map[string]string{"env/default.env": "LISTEN=0.0.0.0:80\nWORKERS=4\n"})
+	if err := Doctor(args); err == nil {
+		t.Error("expected error for output differing from fixture")
+	}
+
+	// schema of manifest is checked
+	writeFiles(t, root, map[string]string{"env/default.env": "LISTEN=0.0.0.0:8080\nWORKERS=many\n"})
+	if err := Doctor(args); err == nil {
+		t.Error("expected error for variable not matching schema")
+	}
+	if _, err := os.Stat(filepath.Join(root, "out")); !os.IsNotExist(err) {
+		t.Errorf("doctor created output dir: %v", err)
+	}
+}
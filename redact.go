@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Redaction
+//
+// Values of secret variables are never shown as is in reports. Strategy
+// decides what is shown instead:
+//
+//	full      ****
+//	last:N    ****cdef, last N characters, 4 by default
+//	length    ********, one * per character
+//	hmac      hmac:1a2b3c4d5e6f, prefix of HMAC-SHA256 keyed by
+//	          ENVTEMPLATER_REDACT_KEY or -redact-key file, so values can be
+//	          compared across hosts without revealing them
+type Redactor struct {
+	strategy string
+	last     int
+	key      []byte
+	// secret holds names of secret variables besides ones matched by name
+	secret map[string]bool
+}
+
+var secretNameParts = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "PRIVATE"}
+
+func NewRedactor(strategy, keyFile, secretEnv string) (*Redactor, error) {
+	r := &Redactor{strategy: strategy, last: 4, secret: map[string]bool{}}
+	for _, name := range strings.Split(secretEnv, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			r.secret[name] = true
+		}
+	}
+
+	if name, n, ok := strings.Cut(strategy, ":"); ok && name == "last" {
+		last, err := strconv.Atoi(n)
+		if err != nil || last < 0 {
+			return nil, fmt.Errorf("Bad redact strategy '%v', expected last:N", strategy)
+		}
+		r.strategy, r.last = "last", last
+	}
+
+	switch r.strategy {
+	case "", "full", "last", "length":
+	case "hmac":
+		key := os.Getenv("ENVTEMPLATER_REDACT_KEY")
+		if keyFile != "" {
+			b, err := os.ReadFile(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			key = strings.TrimSpace(string(b))
+		}
+		if key == "" {
+			return nil, fmt.Errorf("Required ENVTEMPLATER_REDACT_KEY or -redact-key for hmac redaction")
+		}
+		r.key = []byte(key)
+	default:
+		return nil, fmt.Errorf("Unknown redact strategy '%v'", strategy)
+	}
+	return r, nil
+}
+
+func (r *Redactor) IsSecret(name string) bool {
+	if r.secret[name] {
+		return true
+	}
+	upper := strings.ToUpper(name)
+	for _, part := range secretNameParts {
+		if strings.Contains(upper, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactor) Redact(value string) string {
+	switch r.strategy {
+	case "last":
+		n := utf8.RuneCountInString(value)
+		if n <= r.last {
+			return "****"
+		}
+		return "****" + string([]rune(value)[n-r.last:])
+	case "length":
+		return strings.Repeat("*", utf8.RuneCountInString(value))
+	case "hmac":
+		h := hmac.New(sha256.New, r.key)
+		h.Write([]byte(value))
+		return "hmac:" + hex.EncodeToString(h.Sum(nil))[:12]
+	}
+	return "****"
+}
+
+// Display returns value of variable as it may be shown in reports
+func (r *Redactor) Display(name, value string) string {
+	if r.IsSecret(name) {
+		return r.Redact(value)
+	}
+	return strconv.Quote(value)
+}
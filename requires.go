@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Required variables
+//
+// Template may declare variables it needs with optional types, either in
+// front matter or in leading comment, which may follow front matter:
+//
+//	{{/* requires: DB_HOST:string DB_PORT:int */}}
+//
+// Requirements of whole subtree are declared by requires key of dir manifest.
+//
+// Declarations of all files are checked before anything is rendered.
+type Requirement struct {
+	Name string
+	Type string
+}
+
+var requirementTypes = map[string]func(string) error{
+	"string": func(string) error { return nil },
+	"int": func(v string) error {
+		_, err := strconv.ParseInt(v, 10, 64)
+		return err
+	},
+	"uint": func(v string) error {
+		_, err := strconv.ParseUint(v, 10, 64)
+		return err
+	},
+	"float": func(v string) error {
+		_, err := strconv.ParseFloat(v, 64)
+		return err
+	},
+	"bool": func(v string) error {
+		_, err := strconv.ParseBool(v)
+		return err
+	},
+	"duration": func(v string) error {
+		_, err := time.ParseDuration(v)
+		return err
+	},
+	"url": func(v string) error {
+		u, err := url.Parse(v)
+		if err == nil && (u.Scheme == "" || u.Host == "") {
+			err = fmt.Errorf("missing scheme or host")
+		}
+		return err
+	},
+}
+
+func parseRequirements(s string) ([]Requirement, error) {
+	requirements := []Requirement{}
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		name, typ, ok := strings.Cut(field, ":")
+		if !ok {
+			typ = "string"
+		}
+		if _, known := requirementTypes[typ]; !known || name == "" {
+			return nil, fmt.Errorf("Bad requirement '%v'", field)
+		}
+		requirements = append(requirements, Requirement{name, typ})
+	}
+	return requirements, nil
+}
+
+// Requirements returns variables declared by template
+func (tf *TemplateFile) Requirements() ([]Requirement, error) {
+	declared := tf.FrontMatter["requires"]
+
+	left, right := tf.Settings.LeftDelim, tf.Settings.RightDelim
+	if left == "" {
+		left, right = "{{", "}}"
+	}
+	re := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(left) + `-?\s*/\*\s*requires:((?s).*?)\*/\s*-?` + regexp.QuoteMeta(right))
+	body := tf.Input
+	if end := strings.Index(body, frontMatterEnd); strings.HasPrefix(body, frontMatterStart) && end != -1 {
+		body = body[end+len(frontMatterEnd):]
+	}
+	if m := re.FindStringSubmatch(body); m != nil {
+		declared += " " + m[1]
+	}
+
+	requirements, err := parseRequirements(declared)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", tf.InputPath, err)
+	}
+	return append(append([]Requirement{}, tf.Settings.Requires...), requirements...), nil
+}
+
+// checkRequirements checks declarations of all files, returning every
+// problem at once
+func checkRequirements(templateFiles []*TemplateFile) error {
+	problems := []string{}
+	for _, templateFile := range templateFiles {
+		for _, problem := range templateFile.unmetRequirements() {
+			problems = append(problems, templateFile.InputPath+": "+problem)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Required variables are missing or invalid:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func (tf *TemplateFile) unmetRequirements() []string {
+	requirements, err := tf.Requirements()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	problems := []string{}
+	for _, requirement := range requirements {
+		value, ok := tf.TemplateContext.lookup(requirement.Name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v (%v) is missing", requirement.Name, requirement.Type))
+			continue
+		}
+		err := requirementTypes[requirement.Type](value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v is not %v: %v",
+				requirement.Name, requirement.Type, tf.TemplateContext.redactor.Display(requirement.Name, value)))
+		}
+	}
+	return problems
+}
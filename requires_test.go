@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequirements(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []Requirement
+	}{
+		{
+			name:  "leading comment",
+			input: "{{/* requires: A:int B */}}\na",
+			want:  []Requirement{{"A", "int"}, {"B", "string"}},
+		},
+		{
+			name:  "comment after front matter",
+			input: "{{/*---\nmode: 0600\n---*/}}\n{{- /* requires: A:int */ -}}\na",
+			want:  []Requirement{{"A", "int"}},
+		},
+		{
+			name:  "front matter and comment together",
+			input: "{{/*---\nrequires: A:url\n---*/}}\n{{/* requires: B:bool */}}\na",
+			want:  []Requirement{{"A", "url"}, {"B", "bool"}},
+		},
+		{
+			name:  "comment after content is ignored",
+			input: "a\n{{/* requires: A:int */}}",
+			want:  []Requirement{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTestFile(tt.input, nil).Requirements()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunMissingRequirementsCreatesNothing(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	writeFiles(t, dir, map[string]string{
+		"in/sub/a.conf": `{{/* requires: MISSING_VARIABLE_OF_TEST:int */}}a`,
+	})
+	flags, err := NewFlags([]string{"-id", in, "-od", out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Run(flags)
+	if err == nil || !strings.Contains(err.Error(), "MISSING_VARIABLE_OF_TEST (int) is missing") {
+		t.Fatalf("got %v, want missing variable error", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output dir is created: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 output
+//
+// Output dir or file may be s3://bucket/prefix. Objects are uploaded to S3
+// compatible storage with requests signed by AWS Signature Version 4.
+// Credentials and region come from AWS_* environment variables, endpoint
+// from -s3-endpoint flag or AWS_ENDPOINT_URL. Buckets are addressed in path
+// style, which works both with AWS and with self-hosted storages.
+const s3Scheme = "s3://"
+
+func isS3URL(path string) bool {
+	return strings.HasPrefix(path, s3Scheme)
+}
+
+func parseS3URL(path string) (string, string, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(path, s3Scheme), "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("Bad S3 object '%v', expected s3://bucket/key", path)
+	}
+	return bucket, key, nil
+}
+
+// joinOutput joins output dir and file name, keeping S3 urls intact
+func joinOutput(dir, name string) string {
+	if isS3URL(dir) {
+		return strings.TrimSuffix(dir, "/") + "/" + strings.ReplaceAll(name, string(os.PathSeparator), "/")
+	}
+	return filepath.Join(dir, name)
+}
+
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+}
+
+func newS3Client(endpoint string) (*s3Client, error) {
+	c := &s3Client{
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		http:         &http.Client{Timeout: 60 * time.Second},
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("Required AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY for S3 output")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + c.region + ".amazonaws.com"
+	}
+
+	var err error
+	c.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (c *s3Client) do(method, path string, body []byte) (*http.Response, error) {
+	bucket, key, err := parseS3URL(path)
+	if err != nil {
+		return nil, err
+	}
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body, time.Now().UTC())
+	return c.http.Do(req)
+}
+
+// Get returns content of object, empty when object does not exist
+func (c *s3Client) Get(path string) (string, error) {
+	resp, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	switch {
+	case err != nil:
+		return "", err
+	case resp.StatusCode == http.StatusNotFound:
+		return "", nil
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("Failed get %v: %v", path, resp.Status)
+	}
+	return string(b), nil
+}
+
+// Put uploads object unless ETag of existing one matches content, returns
+// true when upload was skipped
+func (c *s3Client) Put(path string, body []byte) (bool, error) {
+	resp, err := c.do(http.MethodHead, path, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	sum := md5.Sum(body)
+	if resp.StatusCode == http.StatusOK && strings.Trim(resp.Header.Get("ETag"), `"`) == hex.EncodeToString(sum[:]) {
+		return true, nil
+	}
+
+	resp, err = c.do(http.MethodPut, path, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("Failed put %v: %v %s", path, resp.Status, msg)
+	}
+	return false, nil
+}
+
+// Signature Version 4
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3EscapePath escapes everything except unreserved characters and '/'
+func s3EscapePath(path string) string {
+	buf := new(strings.Builder)
+	for _, c := range []byte(path) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := new(strings.Builder)
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		c.accessKey, scope, signedHeaders, signature,
+	))
+}
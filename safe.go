@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Safe mode
+//
+// Safe mode is meant for templates which are not fully trusted. Functions
+// with side effects or access outside of the template are denied, only
+// variables from allowlist can be read and execution is limited in time and
+// output size.
+const safeMaxOutput = 10 << 20
+
+var safeTimeout = 10 * time.Second
+
+// unsafeFuncs are denied in safe mode
+var unsafeFuncs = []string{
+	// write state file
+	"changeCounter",
+	"changeSerial",
+	// network access
+	"dnsSRV",
+	"dnsA",
+	"dnsTXT",
+}
+
+func deniedFunc(name string) func(...interface{}) (string, error) {
+	return func(...interface{}) (string, error) {
+		return "", fmt.Errorf("Function '%v' is not allowed in safe mode", name)
+	}
+}
+
+func (tx *TemplateContext) EnableSafeMode(allowEnv string) {
+	tx.safe = true
+	tx.allowed = map[string]bool{}
+	for _, name := range strings.Split(allowEnv, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			tx.allowed[name] = true
+		}
+	}
+}
+
+func (tx *TemplateContext) lookup(name string) (string, bool) {
+	if tx.safe && !tx.allowed[name] {
+		return "", false
+	}
+	v, ok := tx.envs[name]
+	return v, ok
+}
+
+// limitedWriter fails writes over size limit and after execution is canceled
+type limitedWriter struct {
+	w        io.Writer
+	n        int
+	canceled *atomic.Bool
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if lw.canceled.Load() {
+		return 0, errCanceled
+	}
+	if len(p) > lw.n {
+		return 0, fmt.Errorf("Template output exceeds size limit %v bytes", safeMaxOutput)
+	}
+	lw.n -= len(p)
+	return lw.w.Write(p)
+}
+
+// Execution can't be interrupted from outside, so in safe mode loop bodies
+// and defined templates start with call of guardFunc, which fails once time
+// limit is exceeded. Together with writer failing after cancel this stops
+// loops and recursion even when they write nothing.
+const (
+	guardFunc = "envtemplaterGuard"
+	// guardGrace is time given to canceled execution to stop
+	guardGrace = time.Second
+)
+
+var errCanceled = fmt.Errorf("Template execution was canceled")
+
+func (tf *TemplateFile) guard() (string, error) {
+	if tf.canceled.Load() {
+		return "", errCanceled
+	}
+	return "", nil
+}
+
+func isGuard(node parse.Node) bool {
+	action, ok := node.(*parse.ActionNode)
+	if !ok || len(action.Pipe.Cmds) != 1 {
+		return false
+	}
+	ident, ok := action.Pipe.Cmds[0].Args[0].(*parse.IdentifierNode)
+	return ok && ident.Ident == guardFunc
+}
+
+// guardLoops adds guard to bodies of ranges and defined templates
+func guardLoops(t *template.Template) {
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			guardList(tmpl.Tree.Root)
+		}
+	}
+}
+
+func guardList(list *parse.ListNode) {
+	if list == nil {
+		return
+	}
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.IfNode:
+			guardList(n.List)
+			guardList(n.ElseList)
+		case *parse.WithNode:
+			guardList(n.List)
+			guardList(n.ElseList)
+		case *parse.RangeNode:
+			guardList(n.List)
+			guardList(n.ElseList)
+		}
+	}
+	if len(list.Nodes) > 0 && isGuard(list.Nodes[0]) {
+		return
+	}
+	guard := &parse.ActionNode{
+		NodeType: parse.NodeAction,
+		Pipe: &parse.PipeNode{
+			NodeType: parse.NodePipe,
+			Cmds: []*parse.CommandNode{{
+				NodeType: parse.NodeCommand,
+				Args:     []parse.Node{parse.NewIdentifier(guardFunc)},
+			}},
+		},
+	}
+	list.Nodes = append([]parse.Node{guard}, list.Nodes...)
+}
+
+// execute runs template with data of file, applying limits in safe mode
+func (tf *TemplateFile) execute(templater *template.Template, w io.Writer) error {
+	if !tf.TemplateContext.safe {
+		return templater.Execute(w, tf.data())
+	}
+
+	guardLoops(templater)
+	w = &limitedWriter{w: w, n: safeMaxOutput, canceled: &tf.canceled}
+	// nested templates are covered by time limit of the outer one
+	if tf.tplDepth > 0 {
+		return templater.Execute(w, tf.data())
+	}
+
+	tf.canceled.Store(false)
+	done := make(chan error, 1)
+	go func() {
+		done <- templater.Execute(w, tf.data())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(safeTimeout):
+	}
+
+	// wait for execution to stop, so it does not change file while caller
+	// goes on. Single function call still running after grace time can't be
+	// stopped, its goroutine is leaked until the call returns.
+	tf.canceled.Store(true)
+	select {
+	case <-done:
+	case <-time.After(guardGrace):
+	}
+	return fmt.Errorf("Template execution exceeds time limit %v", safeTimeout)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestSafeModeStopsLoopsOnTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { safeTimeout = timeout }(safeTimeout)
+	safeTimeout = 100 * time.Millisecond
+
+	// slice of empty structs takes no memory, ranging over integers needs
+	// newer Go than go.mod declares
+	many := template.FuncMap{"many": func() []struct{} { return make([]struct{}, 100000000000) }}
+	for _, input := range []string{
+		`{{ range many }}{{ end }}`,
+		`{{ range many }}{{ if true }}{{ end }}{{ end }}`,
+		`{{ define "r" }}{{ range many }}{{ end }}{{ end }}{{ template "r" }}`,
+		`{{ range many }}x{{ end }}`,
+	} {
+		before := runtime.NumGoroutine()
+		tf := newTestFile(input, nil)
+		tf.TemplateContext.EnableSafeMode("")
+		templater, err := tf.newTemplate(tf.InputPath).Funcs(many).Parse(tf.Input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tf.templater = templater
+
+		start := time.Now()
+		err = tf.Template()
+		if err == nil || !strings.Contains(err.Error(), "time limit") {
+			t.Errorf("%v: got %v, want time limit error", input, err)
+		}
+		if elapsed := time.Since(start); elapsed > safeTimeout+guardGrace {
+			t.Errorf("%v: took %v", input, elapsed)
+		}
+		if after := runtime.NumGoroutine(); after > before {
+			t.Errorf("%v: execution goroutine is still running", input)
+		}
+	}
+}
+
+func TestSafeModeDeniesUnsafe(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`{{ .Env "SECRET" }}`, "not allowed in safe mode"},
+		{`{{ changeCounter "x" }}`, "not allowed in safe mode"},
+		{`{{ dnsA "example.com" }}`, "not allowed in safe mode"},
+		{`{{ .Current }}`, "not available in safe mode"},
+	}
+	for _, tt := range tests {
+		tf := newTestFile(tt.input, map[string]string{"SECRET": "x", "PUBLIC": "y"})
+		tf.TemplateContext.EnableSafeMode("PUBLIC")
+		err := tf.Template()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want error %q", tt.input, err, tt.want)
+		}
+	}
+
+	tf := newTestFile(`{{ .Env "PUBLIC" }}`, map[string]string{"PUBLIC": "y"})
+	tf.TemplateContext.EnableSafeMode("PUBLIC")
+	if err := tf.Template(); err != nil || tf.Output != "y" {
+		t.Errorf("got %q, %v", tf.Output, err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Selection
+//
+// -only and -skip take comma separated globs of output names or "tag:name"
+// entries, matched against tags from front matter and dir manifests.
+// -changed-since selects templates, whose sources, dir manifests or env files
+// listed by manifests changed since git ref.
+type selector struct {
+	only []string
+	skip []string
+	// changed holds input names changed since ref, nil when not used
+	changed map[string]bool
+	// changedDirs holds dirs with changed manifests
+	changedDirs []string
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func newSelector(flags Flags) (*selector, error) {
+	s := &selector{
+		only: splitList(flags.Only),
+		skip: splitList(flags.Skip),
+	}
+	if flags.ChangedSince == "" {
+		return s, nil
+	}
+
+	names := []string{}
+	for _, args := range [][]string{
+		{"diff", "--name-only", "--relative", flags.ChangedSince, "--", "."},
+		{"ls-files", "--others", "--exclude-standard", "--", "."},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = flags.ID
+		out, err := cmd.Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return nil, fmt.Errorf("Failed git %v: %v\n%s", args[0], err, exitErr.Stderr)
+			}
+			return nil, err
+		}
+		names = append(names, strings.Split(strings.TrimSpace(string(out)), "\n")...)
+	}
+
+	s.changed = map[string]bool{}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		s.changed[name] = true
+		if path.Base(name) == manifestFileName {
+			s.changedDirs = append(s.changedDirs, path.Dir(name))
+		}
+	}
+	return s, nil
+}
+
+func (s *selector) active() bool {
+	return len(s.only) > 0 || len(s.skip) > 0 || s.changed != nil
+}
+
+func (s *selector) match(entries []string, tf *TemplateFile) bool {
+	for _, entry := range entries {
+		if tag, ok := strings.CutPrefix(entry, "tag:"); ok {
+			for _, t := range tf.Tags() {
+				if t == tag {
+					return true
+				}
+			}
+		} else if matchGlob(entry, tf.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *selector) selected(tf *TemplateFile, inputDir string) bool {
+	if len(s.only) > 0 && !s.match(s.only, tf) {
+		return false
+	}
+	if s.match(s.skip, tf) {
+		return false
+	}
+	if s.changed == nil {
+		return true
+	}
+
+	name, err := filepath.Rel(inputDir, tf.InputPath)
+	if err != nil {
+		return true
+	}
+	name = filepath.ToSlash(name)
+	if s.changed[name] {
+		return true
+	}
+	for _, dir := range s.changedDirs {
+		if dir == "." || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	// env files of manifest are sources of its whole subtree
+	for _, envFile := range tf.Settings.EnvFiles {
+		name, err := filepath.Rel(inputDir, envFile)
+		if err == nil && s.changed[filepath.ToSlash(name)] {
+			return true
+		}
+	}
+	return false
+}
+
+// split returns selected and unselected files
+func (s *selector) split(templateFiles []*TemplateFile, inputDir string) ([]*TemplateFile, []*TemplateFile) {
+	if !s.active() {
+		return templateFiles, nil
+	}
+	selected, unselected := []*TemplateFile{}, []*TemplateFile{}
+	for _, templateFile := range templateFiles {
+		if s.selected(templateFile, inputDir) {
+			selected = append(selected, templateFile)
+		} else {
+			unselected = append(unselected, templateFile)
+		}
+	}
+	return selected, unselected
+}
+
+// Tags returns tags of file from front matter and dir manifests
+func (tf *TemplateFile) Tags() []string {
+	tags := append([]string{}, tf.Settings.Tags...)
+	for _, tag := range strings.FieldsFunc(tf.FrontMatter["tags"], func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+var hashedNameRe = regexp.MustCompile(`\.[0-9a-f]{6}(\.[^./]*)?$`)
+
+// unhashedName returns name without content hash added by hashName
+func unhashedName(name string) string {
+	loc := hashedNameRe.FindStringSubmatchIndex(name)
+	if loc == nil {
+		return name
+	}
+	return name[:loc[0]] + name[loc[2]:]
+}
+
+// loadAssetManifest seeds assets with manifest of previous run, so files
+// which are not selected can still be referred
+func (tx *TemplateContext) loadAssetManifest(dir string) error {
+	b, err := os.ReadFile(filepath.Join(dir, assetManifestName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &tx.assets)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestChangedSince(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	tests := []struct {
+		name    string
+		changed map[string]string
+		want    []string
+	}{
+		{"template", map[string]string{"other/b.conf": "b2"}, []string{"other/b.conf"}},
+		{"manifest", map[string]string{"team/" + manifestFileName: "env_files = [\"team.env\"]\ntags = [\"t\"]\n"}, []string{"team/a.conf", "team/sub/c.conf"}},
+		{"env file of manifest", map[string]string{"team/team.env": "A=2\n"}, []string{"team/a.conf", "team/sub/c.conf"}},
+		{"new file", map[string]string{"other/new.conf": "n"}, []string{"other/new.conf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+			writeFiles(t, in, map[string]string{
+				"team/" + manifestFileName: "env_files = [\"team.env\"]\n",
+				"team/team.env":            "A=1\n",
+				"team/a.conf":              `{{ .Env "A" }}`,
+				"team/sub/c.conf":          `c`,
+				"other/b.conf":             `b`,
+			})
+			for _, args := range [][]string{
+				{"init", "-q"},
+				{"add", "."},
+				{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+			} {
+				cmd := exec.Command("git", args...)
+				cmd.Dir = in
+				if b, err := cmd.CombinedOutput(); err != nil {
+					t.Fatalf("git %v: %v\n%s", args, err, b)
+				}
+			}
+			writeFiles(t, in, tt.changed)
+
+			flags, err := NewFlags([]string{"-id", in, "-od", out, "-changed-since", "HEAD"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Run(flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := recursiveGetFiles(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]bool{}
+			for _, name := range tt.want {
+				want[filepath.FromSlash(name)] = true
+			}
+			if len(got) != len(want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			for _, name := range got {
+				if !want[name] {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// State file
+//
+// State kept between runs, stored as json at path given by -sf flag.
+func LoadState(path string) (*State, error) {
+	state := &State{
+		path:     path,
+		Counters: map[string]*CounterState{},
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Counters == nil {
+		state.Counters = map[string]*CounterState{}
+	}
+	return state, nil
+}
+
+type State struct {
+	path    string
+	changed bool
+
+	Counters map[string]*CounterState `json:"counters"`
+	// Outputs holds names of rendered files by output dir
+	Outputs map[string][]string `json:"outputs,omitempty"`
+}
+
+type CounterState struct {
+	Value int64  `json:"value"`
+	Hash  string `json:"hash"`
+}
+
+// bumpCounter increases counter when hash of content differs from hash seen
+// last time. Dated counters have YYYYMMDDnn form.
+func (s *State) bumpCounter(name, hash string, dated bool, now time.Time) int64 {
+	counter, ok := s.Counters[name]
+	if !ok {
+		counter = &CounterState{}
+		s.Counters[name] = counter
+	}
+	if ok && counter.Hash == hash {
+		return counter.Value
+	}
+
+	if dated {
+		today, _ := strconv.ParseInt(now.Format("20060102"), 10, 64)
+		if counter.Value < today*100 {
+			counter.Value = today * 100
+		} else {
+			counter.Value++
+		}
+	} else {
+		counter.Value++
+	}
+	counter.Hash = hash
+	s.changed = true
+	return counter.Value
+}
+
+// outputsKey returns key of dir in Outputs, which does not depend on working
+// dir. Keys of older state files are relative, they are moved to absolute
+// ones when found.
+func (s *State) outputsKey(dir string) string {
+	if isS3URL(dir) {
+		return strings.TrimSuffix(dir, "/")
+	}
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return filepath.Clean(dir)
+	}
+	if old := filepath.Clean(dir); old != key {
+		if names, ok := s.Outputs[old]; ok {
+			if _, exists := s.Outputs[key]; !exists {
+				s.Outputs[key] = names
+			}
+			delete(s.Outputs, old)
+			s.changed = true
+		}
+	}
+	return key
+}
+
+// replaceOutputs records names rendered into dir, returning names rendered
+// last time which are not rendered anymore. Outputs of unselected files are
+// kept as is.
+func (s *State) replaceOutputs(dir string, names, unselected []string) []string {
+	if s.Outputs == nil {
+		s.Outputs = map[string][]string{}
+	}
+	dir = s.outputsKey(dir)
+	current := map[string]bool{}
+	for _, name := range names {
+		current[name] = true
+	}
+	kept := map[string]bool{}
+	for _, name := range unselected {
+		kept[name] = true
+	}
+	stale := []string{}
+	for _, name := range s.Outputs[dir] {
+		switch {
+		case current[name]:
+		case kept[name] || kept[unhashedName(name)]:
+			names = append(names, name)
+			current[name] = true
+		default:
+			stale = append(stale, name)
+		}
+	}
+
+	sort.Strings(names)
+	if strings.Join(names, "\n") != strings.Join(s.Outputs[dir], "\n") {
+		s.Outputs[dir] = names
+		s.changed = true
+	}
+	return stale
+}
+
+func (s *State) Save() error {
+	if !s.changed {
+		return nil
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(b, '\n'), 0664)
+}
+
+// managed returns true when name was rendered into dir by previous run
+func (s *State) managed(dir, name string) bool {
+	for _, output := range s.Outputs[s.outputsKey(dir)] {
+		if output == name {
+			return true
+		}
+	}
+	return false
+}
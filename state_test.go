@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestPruneDoesNotDependOnWorkingDir(t *testing.T) {
+	dir := t.TempDir()
+	out, state := filepath.Join(dir, "out"), filepath.Join(dir, "state.json")
+	writeFiles(t, dir, map[string]string{"in/a.conf": "a", "in/b.conf": "b"})
+
+	run := func(od string) {
+		t.Helper()
+		flags, err := NewFlags([]string{"-id", filepath.Join(dir, "in"), "-od", od, "-sf", state, "-prune"})
+		if err == nil {
+			err = Run(flags)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(out)
+
+	os.Remove(filepath.Join(dir, "in/b.conf"))
+	chdir(t, dir)
+	run("out")
+	if _, err := os.Stat(filepath.Join(out, "b.conf")); !os.IsNotExist(err) {
+		t.Errorf("b.conf was not pruned: %v", err)
+	}
+
+	s, err := LoadState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{out: {"a.conf"}}
+	if !reflect.DeepEqual(s.Outputs, want) {
+		t.Errorf("got outputs %v, want %v", s.Outputs, want)
+	}
+}
+
+func TestOutputsOfRelativeKeysAreMoved(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	old, _ := json.Marshal(map[string]interface{}{"outputs": map[string][]string{"out": {"a.conf", "b.conf"}}})
+	writeFiles(t, dir, map[string]string{"state.json": string(old)})
+
+	s, err := LoadState("state.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.managed("out", "b.conf") || !s.managed(filepath.Join(dir, "out"), "b.conf") {
+		t.Error("outputs of relative key are not found")
+	}
+	stale := s.replaceOutputs("./out/", []string{"a.conf"}, nil)
+	if !reflect.DeepEqual(stale, []string{"b.conf"}) {
+		t.Errorf("got stale %v", stale)
+	}
+	want := map[string][]string{filepath.Join(dir, "out"): {"a.conf"}}
+	if !reflect.DeepEqual(s.Outputs, want) {
+		t.Errorf("got outputs %v, want %v", s.Outputs, want)
+	}
+}
+
+func TestBumpCounter(t *testing.T) {
+	s := &State{Counters: map[string]*CounterState{}}
+	day := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		name  string
+		hash  string
+		dated bool
+		now   time.Time
+		want  int64
+	}{
+		{"plain", "a", false, day, 1},
+		{"plain", "a", false, day, 1},
+		{"plain", "b", false, day, 2},
+		{"serial", "a", true, day, 2024030500},
+		{"serial", "b", true, day, 2024030501},
+		{"serial", "b", true, day, 2024030501},
+		{"serial", "c", true, day.AddDate(0, 0, 1), 2024030600},
+	}
+	for i, step := range steps {
+		if got := s.bumpCounter(step.name, step.hash, step.dated, step.now); got != step.want {
+			t.Errorf("step %v: got %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestReplaceOutputsKeepsUnselected(t *testing.T) {
+	s := &State{Outputs: map[string][]string{}}
+	s.replaceOutputs("/out", []string{"a.conf", "app.1a2b3c.js", "b.conf"}, nil)
+	stale := s.replaceOutputs("/out", []string{"a.conf"}, []string{"app.js"})
+	if !reflect.DeepEqual(stale, []string{"b.conf"}) {
+		t.Errorf("got stale %v", stale)
+	}
+	if want := []string{"a.conf", "app.1a2b3c.js"}; !reflect.DeepEqual(s.Outputs["/out"], want) {
+		t.Errorf("got outputs %v, want %v", s.Outputs["/out"], want)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// XML edits
+//
+// In xml output mode the rendered template is a list of edits, one per line:
+//
+//	/Server/Service[@name='Catalina']/Connector[@protocol='HTTP/1.1']/@port = 8080
+//	//Connector/@redirectPort = 8443
+//	/settings/localRepository/text() = /var/cache/m2
+//
+// Edits are applied to the document existing at OutputPath. The document is
+// read with a token stream and only the bytes of touched elements are
+// replaced, so formatting, comments and everything else is kept as is.
+
+type xmlStep struct {
+	name       string
+	predicates []xml.Attr
+}
+
+func (s xmlStep) match(name string, attrs []xml.Attr) bool {
+	if s.name != "*" && s.name != name {
+		return false
+	}
+	for _, p := range s.predicates {
+		found := false
+		for _, attr := range attrs {
+			if xmlName(attr.Name) == p.Name.Local && attr.Value == p.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type xmlEdit struct {
+	Selector string
+	steps    []xmlStep
+	anywhere bool
+	// Attr is edited attribute, empty when text of element is edited
+	Attr  string
+	Value string
+	used  bool
+}
+
+func (e *xmlEdit) match(stack []*xmlElement) bool {
+	if len(stack) < len(e.steps) || (!e.anywhere && len(stack) != len(e.steps)) {
+		return false
+	}
+	stack = stack[len(stack)-len(e.steps):]
+	for i, step := range e.steps {
+		if !step.match(stack[i].name, stack[i].attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+var xmlPredicateRe = regexp.MustCompile(`^@([\w:.-]+)\s*=\s*(?:'([^']*)'|"([^"]*)")$`)
+
+func parseXMLSelector(selector string) (*xmlEdit, error) {
+	edit := &xmlEdit{Selector: selector}
+
+	path := selector
+	switch {
+	case strings.HasPrefix(path, "//"):
+		edit.anywhere = true
+		path = path[2:]
+	case strings.HasPrefix(path, "/"):
+		path = path[1:]
+	default:
+		return nil, fmt.Errorf("Selector '%v' must start with '/' or '//'", selector)
+	}
+
+	parts := splitXMLPath(path)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Selector '%v' must end with '/@attr' or '/text()'", selector)
+	}
+	switch last := parts[len(parts)-1]; {
+	case last == "text()":
+	case strings.HasPrefix(last, "@") && len(last) > 1:
+		edit.Attr = last[1:]
+	default:
+		return nil, fmt.Errorf("Selector '%v' must end with '/@attr' or '/text()'", selector)
+	}
+
+	for _, part := range parts[:len(parts)-1] {
+		step := xmlStep{name: part}
+		if i := strings.Index(part, "["); i != -1 {
+			step.name = part[:i]
+			for _, predicate := range strings.Split(strings.TrimSuffix(part[i+1:], "]"), "][") {
+				m := xmlPredicateRe.FindStringSubmatch(strings.TrimSpace(predicate))
+				if m == nil {
+					return nil, fmt.Errorf("Selector '%v' has bad predicate '[%v]'", selector, predicate)
+				}
+				step.predicates = append(step.predicates, xml.Attr{
+					Name:  xml.Name{Local: m[1]},
+					Value: m[2] + m[3],
+				})
+			}
+		}
+		if step.name == "" {
+			return nil, fmt.Errorf("Selector '%v' has empty step", selector)
+		}
+		edit.steps = append(edit.steps, step)
+	}
+	return edit, nil
+}
+
+// splitXMLPath splits path by '/' outside of predicates
+func splitXMLPath(path string) []string {
+	parts := []string{}
+	depth, quote, start := 0, byte(0), 0
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '/' && depth == 0:
+			parts = append(parts, path[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, path[start:])
+}
+
+func parseXMLEdits(s string) ([]*xmlEdit, error) {
+	edits := []*xmlEdit{}
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// selector ends on first space or '=' outside of predicates
+		end, depth, quote := len(line), 0, byte(0)
+	scan:
+		for j := 0; j < len(line); j++ {
+			c := line[j]
+			switch {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"':
+				quote = c
+			case c == '[':
+				depth++
+			case c == ']':
+				depth--
+			case depth == 0 && (c == ' ' || c == '\t' || c == '='):
+				end = j
+				break scan
+			}
+		}
+
+		edit, err := parseXMLSelector(line[:end])
+		if err != nil {
+			return nil, fmt.Errorf("Line %v: %v", i+1, err)
+		}
+		value := strings.TrimSpace(line[end:])
+		edit.Value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+		edits = append(edits, edit)
+	}
+	return edits, nil
+}
+
+type xmlElement struct {
+	name  string
+	attrs []xml.Attr
+	// byte range of start tag
+	start int
+	end   int
+}
+
+type xmlSplice struct {
+	start int
+	end   int
+	text  string
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func xmlEscape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// xmlSetAttr sets attribute of raw start tag. Attributes are scanned with
+// quotes in mind, so text in values of other attributes is never matched.
+func xmlSetAttr(tag, name, value string) string {
+	quoted := `"` + xmlEscape(value) + `"`
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+	i := 1
+	for i < len(tag) && !isSpace(tag[i]) && tag[i] != '/' && tag[i] != '>' {
+		i++
+	}
+	for i < len(tag) {
+		for i < len(tag) && isSpace(tag[i]) {
+			i++
+		}
+		if i >= len(tag) || tag[i] == '/' || tag[i] == '>' {
+			break
+		}
+		start := i
+		for i < len(tag) && !isSpace(tag[i]) && tag[i] != '=' && tag[i] != '/' && tag[i] != '>' {
+			i++
+		}
+		attr := tag[start:i]
+		for i < len(tag) && isSpace(tag[i]) {
+			i++
+		}
+		if i >= len(tag) || tag[i] != '=' {
+			continue
+		}
+		i++
+		for i < len(tag) && isSpace(tag[i]) {
+			i++
+		}
+		if i >= len(tag) || (tag[i] != '"' && tag[i] != '\'') {
+			break
+		}
+		end := strings.IndexByte(tag[i+1:], tag[i])
+		if end == -1 {
+			break
+		}
+		valueStart, valueEnd := i, i+1+end+1
+		if attr == name {
+			return tag[:valueStart] + quoted + tag[valueEnd:]
+		}
+		i = valueEnd
+	}
+
+	at := len(tag) - 1
+	if strings.HasSuffix(tag, "/>") {
+		at = len(tag) - 2
+	}
+	head := strings.TrimRight(tag[:at], " \t\n")
+	return head + " " + name + "=" + quoted + tag[len(head):]
+}
+
+func applyXMLEdits(current string, edits []*xmlEdit) (string, error) {
+	dec := xml.NewDecoder(strings.NewReader(current))
+	dec.Entity = xml.HTMLEntity
+
+	splices := []xmlSplice{}
+	stack := []*xmlElement{}
+	for {
+		offset := int(dec.InputOffset())
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, &xmlElement{
+				name:  xmlName(t.Name),
+				attrs: t.Attr,
+				start: offset,
+				end:   int(dec.InputOffset()),
+			})
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return "", fmt.Errorf("Unexpected end element '%v'", xmlName(t.Name))
+			}
+			el := stack[len(stack)-1]
+			// decoder does not consume input for end of self-closing element
+			selfClosing := offset == int(dec.InputOffset())
+
+			tag := current[el.start:el.end]
+			var text *string
+			for _, edit := range edits {
+				if !edit.match(stack) {
+					continue
+				}
+				edit.used = true
+				if edit.Attr != "" {
+					tag = xmlSetAttr(tag, edit.Attr, edit.Value)
+				} else {
+					text = &edit.Value
+				}
+			}
+
+			switch {
+			case text != nil && selfClosing:
+				tag = strings.TrimRight(strings.TrimSuffix(tag, "/>"), " \t\n") + ">"
+				splices = append(splices, xmlSplice{el.start, el.end, tag + xmlEscape(*text) + "</" + el.name + ">"})
+			case text != nil:
+				// replaced content drops edits of nested elements
+				kept := splices[:0]
+				for _, s := range splices {
+					if s.start < el.end || s.end > offset {
+						kept = append(kept, s)
+					}
+				}
+				splices = append(kept,
+					xmlSplice{el.start, el.end, tag},
+					xmlSplice{el.end, offset, xmlEscape(*text)},
+				)
+			case tag != current[el.start:el.end]:
+				splices = append(splices, xmlSplice{el.start, el.end, tag})
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	unused := []string{}
+	for _, edit := range edits {
+		if !edit.used {
+			unused = append(unused, edit.Selector)
+		}
+	}
+	if len(unused) > 0 {
+		return "", fmt.Errorf("Selectors matched nothing: %v", strings.Join(unused, ", "))
+	}
+
+	sort.SliceStable(splices, func(i, j int) bool { return splices[i].start < splices[j].start })
+	buf := new(strings.Builder)
+	last := 0
+	for _, s := range splices {
+		buf.WriteString(current[last:s.start])
+		buf.WriteString(s.text)
+		last = s.end
+	}
+	buf.WriteString(current[last:])
+	return buf.String(), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestApplyXMLEdits(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		edits   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "change attribute by predicate",
+			current: `<Server><Connector protocol="HTTP/1.1" port="80"/><Connector protocol="AJP/1.3" port="8009"/></Server>`,
+			edits:   `/Server/Connector[@protocol='HTTP/1.1']/@port = 8080`,
+			want:    `<Server><Connector protocol="HTTP/1.1" port="8080"/><Connector protocol="AJP/1.3" port="8009"/></Server>`,
+		},
+		{
+			name:    "add missing attribute keeping space before end",
+			current: `<a><b x="1" /></a>`,
+			edits:   `/a/b/@y = 2`,
+			want:    `<a><b x="1" y="2" /></a>`,
+		},
+		{
+			name:    "attribute name inside other value is not matched",
+			current: `<a><b description=" port='1'" port="80"/></a>`,
+			edits:   `/a/b/@port = 8080`,
+			want:    `<a><b description=" port='1'" port="8080"/></a>`,
+		},
+		{
+			name:    "attribute name inside other value is not taken as existing",
+			current: `<a><b description="port=1"/></a>`,
+			edits:   `/a/b/@port = 8080`,
+			want:    `<a><b description="port=1" port="8080"/></a>`,
+		},
+		{
+			name:    "change text anywhere keeping comments",
+			current: "<settings>\n  <!-- cache -->\n  <localRepository>/old</localRepository>\n</settings>\n",
+			edits:   `//localRepository/text() = /var/cache/m2`,
+			want:    "<settings>\n  <!-- cache -->\n  <localRepository>/var/cache/m2</localRepository>\n</settings>\n",
+		},
+		{
+			name:    "text of self-closing element",
+			current: `<a><b/></a>`,
+			edits:   `/a/b/text() = x < y`,
+			want:    `<a><b>x &lt; y</b></a>`,
+		},
+		{
+			name:    "selector matching nothing",
+			current: `<a/>`,
+			edits:   `/a/missing/@x = 1`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edits, err := parseXMLEdits(tt.edits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := applyXMLEdits(tt.current, edits)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseXMLSelectorErrors(t *testing.T) {
+	for _, selector := range []string{
+		"a/@x",
+		"/a",
+		"/a/b",
+		"/a[@x]/@y",
+		"//@x",
+	} {
+		if _, err := parseXMLSelector(selector); err == nil {
+			t.Errorf("%v: expected error", selector)
+		}
+	}
+}